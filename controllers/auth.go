@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AuthConfig describes how sellers prove access to their upload jobs
+type AuthConfig struct {
+	// SellerTokenSecret signs seller tokens, every job request is rejected if it is empty
+	SellerTokenSecret string
+}
+
+// SellerToken returns hex encoded HMAC-SHA256 of seller id, sellers send it as "Authorization: Bearer <token>"
+func SellerToken(secret string, sellerId int) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.Itoa(sellerId)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSellerToken reports whether the request carries token of the seller
+func (s *salesController) validSellerToken(r *http.Request, sellerId int) bool {
+	if s.AuthConfig.SellerTokenSecret == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	expected := SellerToken(s.AuthConfig.SellerTokenSecret, sellerId)
+	return hmac.Equal([]byte(token), []byte(expected))
+}
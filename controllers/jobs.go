@@ -0,0 +1,394 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/tealeg/xlsx/v3"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+// eventsHeartbeatInterval is how often comments are sent to keep idle event streams open
+const eventsHeartbeatInterval = 15 * time.Second
+
+// jobView is a job returned by ListJobs
+type jobView struct {
+	models.UploadJob
+	// Duration is in seconds, for a running job it is time passed since its start
+	Duration *float64 `json:"duration,omitempty"`
+}
+
+type jobsPage struct {
+	Items []jobView `json:"items"`
+	Total int       `json:"total"`
+}
+
+type rowErrorsPage struct {
+	Items []models.RowError `json:"items"`
+	Total int               `json:"total"`
+}
+
+type changesPage struct {
+	Items []models.SaleChange `json:"items"`
+	Total int                 `json:"total"`
+}
+
+// findSellerJob returns the job only to the seller given by seller_id who created it, the request must carry
+// token of the seller, see SellerToken. For other sellers the job is not found like an unknown one.
+// Nil is returned when the response is already written.
+func (s *salesController) findSellerJob(w http.ResponseWriter, r *http.Request, jobId string) *models.UploadJob {
+	sellerId, err := strconv.Atoi(r.URL.Query().Get("seller_id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of seller_id, must be integer")
+		return nil
+	}
+	if !s.validSellerToken(r, sellerId) {
+		writeError(w, http.StatusUnauthorized, "Invalid seller token")
+		return nil
+	}
+
+	job, err := s.Jobs.FindById(jobId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"job_id": jobId,
+		}).Errorln("Error getting job")
+
+		writeError(w, http.StatusInternalServerError, "Error getting job")
+		return nil
+	}
+	if job == nil || job.SellerId != sellerId {
+		writeError(w, http.StatusNotFound, "Job not found")
+		return nil
+	}
+	return job
+}
+
+// GetJobErrors returns rows rejected during the job as a JSON page, or annotated copy of uploaded file
+// when format is csv or xlsx
+func (s *salesController) GetJobErrors(w http.ResponseWriter, r *http.Request) {
+	jobId := mux.Vars(r)["id"]
+
+	job := s.findSellerJob(w, r, jobId)
+	if job == nil {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		s.writeRowErrorsPage(w, r, jobId)
+	case "csv", "xlsx":
+		s.writeAnnotatedFile(w, job, format)
+	default:
+		writeError(w, http.StatusBadRequest, "Invalid value of format, must be one of json, csv, xlsx")
+	}
+}
+
+func (s *salesController) writeRowErrorsPage(w http.ResponseWriter, r *http.Request, jobId string) {
+	limit, err := parseIntParam(r, "limit", DefaultPageLimit)
+	if err != nil || limit <= 0 || limit > MaxPageLimit {
+		writeError(w, http.StatusBadRequest, "Invalid value of limit, must be integer from 1 to 1000")
+		return
+	}
+
+	offset, err := parseIntParam(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid value of offset, must be non-negative integer")
+		return
+	}
+
+	rowErrors, total, err := s.Jobs.FindRowErrors(jobId, limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting row errors")
+		return
+	}
+
+	writeJson(w, rowErrorsPage{
+		Items: rowErrors,
+		Total: total,
+	})
+}
+
+func (s *salesController) writeAnnotatedFile(w http.ResponseWriter, job *models.UploadJob, format string) {
+	if !job.Finished() || job.FilePath == "" {
+		writeError(w, http.StatusConflict, "Uploaded file isn't processed yet")
+		return
+	}
+
+	rowErrors, _, err := s.Jobs.FindRowErrors(job.JobId, 0, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting row errors")
+		return
+	}
+
+	source, err := models.OpenRowSource(job.FilePath, job.Source)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"job_id":    job.JobId,
+			"file_path": job.FilePath,
+		}).Errorln("Error opening uploaded file")
+
+		writeError(w, http.StatusInternalServerError, "Error opening uploaded file")
+		return
+	}
+	defer source.Close()
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+job.JobId+`_errors.csv"`)
+		err = models.WriteAnnotatedCSV(w, source, rowErrors)
+	} else {
+		var annotated *xlsx.File
+		annotated, err = models.AnnotateExcel(source, rowErrors)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+job.JobId+`_errors.xlsx"`)
+			err = annotated.Write(w)
+		}
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"job_id": job.JobId,
+			"format": format,
+		}).Errorln("Error writing annotated file")
+	}
+}
+
+// GetJobChanges returns page of changes found by dry run of the job, they may be filtered by action.
+// Rows rejected by the dry run are returned by GetJobErrors.
+func (s *salesController) GetJobChanges(w http.ResponseWriter, r *http.Request) {
+	jobId := mux.Vars(r)["id"]
+
+	job := s.findSellerJob(w, r, jobId)
+	if job == nil {
+		return
+	}
+	if !job.DryRun {
+		writeError(w, http.StatusConflict, "Job isn't a dry run, its changes are already applied")
+		return
+	}
+
+	action := models.ChangeAction(r.URL.Query().Get("action"))
+	if action != "" && !models.IsValidChangeAction(action) {
+		writeError(w, http.StatusBadRequest, "Invalid value of action, must be one of create, update, delete, remove")
+		return
+	}
+
+	limit, err := parseIntParam(r, "limit", DefaultPageLimit)
+	if err != nil || limit <= 0 || limit > MaxPageLimit {
+		writeError(w, http.StatusBadRequest, "Invalid value of limit, must be integer from 1 to 1000")
+		return
+	}
+
+	offset, err := parseIntParam(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid value of offset, must be non-negative integer")
+		return
+	}
+
+	changes, total, err := s.Jobs.FindChanges(jobId, action, limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting changes")
+		return
+	}
+
+	writeJson(w, changesPage{
+		Items: changes,
+		Total: total,
+	})
+}
+
+// GetJobEvents streams status of the job as Server-Sent Events: "progress" events while it is queued
+// or running and a single "done" event with the final result
+func (s *salesController) GetJobEvents(w http.ResponseWriter, r *http.Request) {
+	jobId := mux.Vars(r)["id"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	if s.findSellerJob(w, r, jobId) == nil {
+		return
+	}
+
+	// subscribing before reading the status makes sure no update is lost in between
+	updates, unsubscribe := s.Worker.Subscribe(jobId)
+	defer unsubscribe()
+
+	status, err := s.Worker.GetJobStatus(jobId)
+	if err == ErrJobNotFound {
+		writeError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting job status")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	writeStatusEvent(w, status)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for !status.Ready {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			status = update
+			writeStatusEvent(w, status)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStatusEvent(w io.Writer, status UploadStatus) {
+	event := "progress"
+	if status.Ready {
+		event = "done"
+	}
+	statusJson, _ := json.Marshal(status)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, statusJson)
+}
+
+// CancelJob stops queued or running job, cancellation of a running job is finished asynchronously,
+// so the returned status may still be running
+func (s *salesController) CancelJob(w http.ResponseWriter, r *http.Request) {
+	jobId := mux.Vars(r)["id"]
+	if s.findSellerJob(w, r, jobId) == nil {
+		return
+	}
+
+	err := s.Worker.CancelJob(jobId)
+	if err == ErrJobNotFound {
+		writeError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if err == ErrJobFinished {
+		writeError(w, http.StatusConflict, "Job is already finished")
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"job_id": jobId,
+		}).Errorln("Error cancelling job")
+
+		writeError(w, http.StatusInternalServerError, "Error cancelling job")
+		return
+	}
+
+	status, err := s.Worker.GetJobStatus(jobId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting job status")
+		return
+	}
+	statusJson, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(statusJson)
+}
+
+// ListJobs returns page of jobs of the seller given by seller_id, the newest go first. Jobs may be filtered by
+// comma separated list of states in status, and creation time bounds from and to in RFC 3339 format.
+// The request must carry token of the seller, see SellerToken.
+func (s *salesController) ListJobs(w http.ResponseWriter, r *http.Request) {
+	filter := models.JobFilter{}
+
+	// sellers see only their own jobs
+	sellerId, err := strconv.Atoi(r.URL.Query().Get("seller_id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of seller_id, must be integer")
+		return
+	}
+	if !s.validSellerToken(r, sellerId) {
+		writeError(w, http.StatusUnauthorized, "Invalid seller token")
+		return
+	}
+	filter.SellerId = &sellerId
+
+	for _, states := range r.URL.Query()["status"] {
+		for _, state := range strings.Split(states, ",") {
+			state := models.JobState(strings.TrimSpace(state))
+			if !models.IsValidJobState(state) {
+				writeError(w, http.StatusBadRequest, "Invalid value of status, must be one of queued, running, done, failed, cancelled")
+				return
+			}
+			filter.States = append(filter.States, state)
+		}
+	}
+
+	filter.From, err = parseTimeParam(r, "from")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of from, must be time in RFC 3339 format")
+		return
+	}
+	filter.To, err = parseTimeParam(r, "to")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of to, must be time in RFC 3339 format")
+		return
+	}
+
+	filter.Limit, err = parseIntParam(r, "limit", DefaultPageLimit)
+	if err != nil || filter.Limit <= 0 || filter.Limit > MaxPageLimit {
+		writeError(w, http.StatusBadRequest, "Invalid value of limit, must be integer from 1 to 1000")
+		return
+	}
+
+	filter.Offset, err = parseIntParam(r, "offset", 0)
+	if err != nil || filter.Offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid value of offset, must be non-negative integer")
+		return
+	}
+
+	jobs, total, err := s.Jobs.FindJobs(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting jobs")
+		return
+	}
+
+	now := time.Now()
+	page := jobsPage{
+		Items: make([]jobView, 0, len(jobs)),
+		Total: total,
+	}
+	for _, job := range jobs {
+		view := jobView{UploadJob: job}
+		if job.StartedAt != nil {
+			finishedAt := now
+			if job.FinishedAt != nil {
+				finishedAt = *job.FinishedAt
+			}
+			duration := finishedAt.Sub(*job.StartedAt).Seconds()
+			view.Duration = &duration
+		}
+		page.Items = append(page.Items, view)
+	}
+	writeJson(w, page)
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// DefaultRisePercent is the price rise for which offers are listed by GetPriceStats by default
+const DefaultRisePercent = 10
+
+type pricesPage struct {
+	Items []models.PricePoint `json:"items"`
+	Total int                 `json:"total"`
+}
+
+// GetPriceHistory returns prices of the offer starting from the price it was created with
+func (s *salesController) GetPriceHistory(w http.ResponseWriter, r *http.Request) {
+	sellerId, err := parseIntVar(r, "seller_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of seller_id, must be integer")
+		return
+	}
+	offerId, err := parseIntVar(r, "offer_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of offer_id, must be integer")
+		return
+	}
+
+	limit, err := parseIntParam(r, "limit", DefaultPageLimit)
+	if err != nil || limit <= 0 || limit > MaxPageLimit {
+		writeError(w, http.StatusBadRequest, "Invalid value of limit, must be integer from 1 to 1000")
+		return
+	}
+
+	offset, err := parseIntParam(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid value of offset, must be non-negative integer")
+		return
+	}
+
+	prices, total, err := s.Sales.FindPriceHistory(r.Context(), sellerId, offerId, limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting prices of offer")
+		return
+	}
+	if total == 0 {
+		writeError(w, http.StatusNotFound, "Offer not found")
+		return
+	}
+
+	writeJson(w, pricesPage{
+		Items: prices,
+		Total: total,
+	})
+}
+
+// GetPriceStats returns stats of price changes made by the job given by job_id,
+// or by the last import of the seller, and lists offers whose price rose more than rise_percent
+func (s *salesController) GetPriceStats(w http.ResponseWriter, r *http.Request) {
+	sellerId, err := parseIntVar(r, "seller_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of seller_id, must be integer")
+		return
+	}
+
+	risePercent := float64(DefaultRisePercent)
+	if risePercentStr := r.URL.Query().Get("rise_percent"); risePercentStr != "" {
+		risePercent, err = strconv.ParseFloat(risePercentStr, 64)
+		if err != nil || risePercent < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid value of rise_percent, must be non-negative number")
+			return
+		}
+	}
+
+	limit, err := parseIntParam(r, "limit", DefaultPageLimit)
+	if err != nil || limit <= 0 || limit > MaxPageLimit {
+		writeError(w, http.StatusBadRequest, "Invalid value of limit, must be integer from 1 to 1000")
+		return
+	}
+
+	var job *models.UploadJob
+	if jobId := r.URL.Query().Get("job_id"); jobId != "" {
+		job, err = s.Jobs.FindById(jobId)
+		// job of another seller looks like an unknown one
+		if job != nil && job.SellerId != sellerId {
+			job = nil
+		}
+	} else {
+		job, err = s.lastImport(sellerId)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"seller_id": sellerId,
+		}).Errorln("Error getting job")
+
+		writeError(w, http.StatusInternalServerError, "Error getting job")
+		return
+	}
+	if job == nil {
+		writeError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	stats, err := s.Sales.FindPriceStats(r.Context(), sellerId, job.JobId, risePercent, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting price stats")
+		return
+	}
+	writeJson(w, stats)
+}
+
+// lastImport returns the latest successful job of the seller which applied changes, dry runs are skipped
+func (s *salesController) lastImport(sellerId int) (*models.UploadJob, error) {
+	filter := models.JobFilter{
+		SellerId: &sellerId,
+		States:   []models.JobState{models.JobDone},
+		Limit:    DefaultPageLimit,
+	}
+	for {
+		jobs, total, err := s.Jobs.FindJobs(filter)
+		if err != nil {
+			return nil, err
+		}
+		for i := range jobs {
+			if !jobs[i].DryRun {
+				return &jobs[i], nil
+			}
+		}
+
+		filter.Offset += len(jobs)
+		if len(jobs) == 0 || filter.Offset >= total {
+			return nil, nil
+		}
+	}
+}
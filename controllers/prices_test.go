@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetPriceStats(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	jobs := models.NewMemoryJobStore()
+	s := &salesController{Sales: &models.Sales{DB: db}, Jobs: jobs}
+
+	createdAt := time.Now()
+	jobs.AddJob(models.UploadJob{JobId: "import", SellerId: 1, State: models.JobDone, CreatedAt: createdAt.Add(-time.Hour)})
+	// dry run changes nothing, so it isn't the last import
+	jobs.AddJob(models.UploadJob{JobId: "dry run", SellerId: 1, State: models.JobDone, DryRun: true, CreatedAt: createdAt})
+	jobs.AddJob(models.UploadJob{JobId: "other seller", SellerId: 2, State: models.JobDone, CreatedAt: createdAt})
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\), (.+) FROM job_prices`).WithArgs(1, "import", 50.0).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "avg", "avg_percent", "risen"}).AddRow(1, 100.0, 100.0, 1))
+	mock.ExpectQuery(`SELECT offer_id, (.+) FROM job_prices`).WithArgs(1, "import", 50.0, DefaultPageLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"offer_id", "old_price", "price", "change_percent"}).AddRow(3, 100, 200, 100.0))
+
+	cases := []struct {
+		name     string
+		sellerId string
+		query    string
+		status   int
+	}{
+		{"last import", "1", "?rise_percent=50", http.StatusOK},
+		{"job of another seller", "1", "?job_id=other+seller", http.StatusNotFound},
+		{"no imports", "3", "", http.StatusNotFound},
+		{"invalid rise_percent", "1", "?rise_percent=-1", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/offers/"+c.sellerId+"/price_stats"+c.query, nil)
+		s.GetPriceStats(w, mux.SetURLVars(r, map[string]string{"seller_id": c.sellerId}))
+
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d %s", c.name, c.status, w.Code, w.Body.String())
+			continue
+		}
+		if c.status == http.StatusOK {
+			var stats models.PriceStats
+			json.Unmarshal(w.Body.Bytes(), &stats)
+			if stats.JobId != "import" || len(stats.Risen) != 1 || stats.Risen[0].OfferId != 3 {
+				t.Errorf("%s: invalid stats %+v", c.name, stats)
+			}
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
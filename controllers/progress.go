@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"sync"
+	"time"
+)
+
+// UploadProgress shows how much of the file is processed by a running job
+type UploadProgress struct {
+	RowsRead int64 `json:"rows_read"`
+	// TotalRows is approximate and includes empty and header rows, it is omitted when unknown
+	TotalRows int64 `json:"total_rows,omitempty"`
+	// Percent and EstimatedFinishAt are set only when TotalRows is known
+	Percent           *float64   `json:"percent,omitempty"`
+	StartedAt         time.Time  `json:"started_at"`
+	EstimatedFinishAt *time.Time `json:"estimated_finish_at,omitempty"`
+}
+
+// jobProgress is updated by the job goroutine and read by GetJobStatus
+type jobProgress struct {
+	mutex     sync.Mutex
+	startedAt time.Time
+	rowsRead  int64
+	totalRows int64
+	result    models.UploadResult
+}
+
+func newJobProgress(startedAt time.Time, totalRows int) *jobProgress {
+	return &jobProgress{
+		startedAt: startedAt,
+		totalRows: int64(totalRows),
+	}
+}
+
+// addRow counts a row read from the file
+func (p *jobProgress) addRow() {
+	p.mutex.Lock()
+	p.rowsRead++
+	p.mutex.Unlock()
+}
+
+func (p *jobProgress) addResult(result models.UploadResult) {
+	p.mutex.Lock()
+	p.result.Add(result)
+	p.mutex.Unlock()
+}
+
+func (p *jobProgress) currentResult() models.UploadResult {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.result
+}
+
+// snapshot estimates finish time assuming the remaining rows are processed at the same rate
+func (p *jobProgress) snapshot(now time.Time) UploadProgress {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	progress := UploadProgress{
+		RowsRead:  p.rowsRead,
+		TotalRows: p.totalRows,
+		StartedAt: p.startedAt,
+	}
+	if p.totalRows <= 0 {
+		return progress
+	}
+
+	rowsRead := p.rowsRead
+	if rowsRead > p.totalRows {
+		rowsRead = p.totalRows
+	}
+	percent := float64(rowsRead) * 100 / float64(p.totalRows)
+	progress.Percent = &percent
+
+	if rowsRead > 0 {
+		elapsed := now.Sub(p.startedAt)
+		remaining := time.Duration(float64(elapsed) * float64(p.totalRows-rowsRead) / float64(rowsRead))
+		finishAt := now.Add(remaining)
+		progress.EstimatedFinishAt = &finishAt
+	}
+	return progress
+}
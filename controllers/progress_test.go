@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"testing"
+	"time"
+)
+
+func TestJobProgress_Snapshot(t *testing.T) {
+	startedAt := time.Date(2020, 12, 1, 10, 0, 0, 0, time.UTC)
+	progress := newJobProgress(startedAt, 4)
+
+	progress.addRow()
+	progress.addResult(models.UploadResult{CreatedSales: 1})
+	progress.addRow()
+	progress.addResult(models.UploadResult{QueryErrors: 1})
+
+	snapshot := progress.snapshot(startedAt.Add(time.Minute))
+	if snapshot.RowsRead != 2 || snapshot.TotalRows != 4 {
+		t.Errorf("Invalid rows counters: %+v", snapshot)
+	}
+	if snapshot.Percent == nil || *snapshot.Percent != 50 {
+		t.Errorf("Invalid percent: %v", snapshot.Percent)
+	}
+	expectedFinishAt := startedAt.Add(2 * time.Minute)
+	if snapshot.EstimatedFinishAt == nil || !snapshot.EstimatedFinishAt.Equal(expectedFinishAt) {
+		t.Errorf("Invalid estimated finish time, expected %s, got %v", expectedFinishAt, snapshot.EstimatedFinishAt)
+	}
+
+	result := progress.currentResult()
+	if result.CreatedSales != 1 || result.QueryErrors != 1 {
+		t.Errorf("Invalid result: %+v", result)
+	}
+
+	// percent and estimation are unknown without total amount of rows
+	snapshot = newJobProgress(startedAt, 0).snapshot(startedAt)
+	if snapshot.Percent != nil || snapshot.EstimatedFinishAt != nil {
+		t.Errorf("Unexpected estimation for unknown total rows: %+v", snapshot)
+	}
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	respJson, _ := json.Marshal(value)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respJson)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	respError := models.Error{
+		Code:    code,
+		Message: message,
+	}
+	respJson, _ := json.Marshal(respError)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respJson)
+}
+
+// parseIntVar returns value of integer path variable
+func parseIntVar(r *http.Request, name string) (int, error) {
+	return strconv.Atoi(mux.Vars(r)[name])
+}
+
+// parseIntParam returns value of integer query parameter or defaultValue if it is absent
+func parseIntParam(r *http.Request, name string, defaultValue int) (int, error) {
+	strValue := r.URL.Query().Get(name)
+	if strValue == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(strValue)
+}
+
+// parseIntListParam collects integers from all occurrences of query parameter, each one may be a comma separated list
+func parseIntListParam(r *http.Request, name string) ([]int, error) {
+	var values []int
+	for _, strValues := range r.URL.Query()[name] {
+		for _, strValue := range strings.Split(strValues, ",") {
+			strValue = strings.TrimSpace(strValue)
+			if strValue == "" {
+				continue
+			}
+			value, err := strconv.Atoi(strValue)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// parseTimeParam returns value of query parameter in RFC 3339 format or nil if it is absent
+func parseTimeParam(r *http.Request, name string) (*time.Time, error) {
+	strValue := r.URL.Query().Get(name)
+	if strValue == "" {
+		return nil, nil
+	}
+	value, err := time.Parse(time.RFC3339, strValue)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
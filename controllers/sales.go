@@ -3,91 +3,203 @@ package controllers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/fertilewaif/avito-mx-backend-test/models"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strconv"
 )
 
+// IdempotencyKeyHeader is a header of /upload request, repeated requests with the same key
+// return the job started by the first one, see WorkerConfig.IdempotencyWindow
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the size of idempotency_key column of upload_jobs
+const maxIdempotencyKeyLength = 255
+
 type SalesController interface {
 	GetSales(w http.ResponseWriter, r *http.Request)
+	GetSaleHistory(w http.ResponseWriter, r *http.Request)
+	GetPriceHistory(w http.ResponseWriter, r *http.Request)
+	GetPriceStats(w http.ResponseWriter, r *http.Request)
 	Upload(w http.ResponseWriter, r *http.Request)
 	GetJobStatus(w http.ResponseWriter, r *http.Request)
+	GetJobErrors(w http.ResponseWriter, r *http.Request)
+	GetJobChanges(w http.ResponseWriter, r *http.Request)
+	GetJobEvents(w http.ResponseWriter, r *http.Request)
+	CancelJob(w http.ResponseWriter, r *http.Request)
+	ListJobs(w http.ResponseWriter, r *http.Request)
 	Close()
 }
 
 type salesController struct {
-	Sales  *models.Sales
-	Worker Worker
+	Sales        *models.Sales
+	Jobs         models.JobStore
+	Worker       Worker
+	UploadConfig UploadConfig
+	AuthConfig   AuthConfig
 }
 
 type uploadRequest struct {
 	SellerId int    `json:"seller_id"`
 	ExcelUrl string `json:"path"`
+	Atomic   bool   `json:"atomic"`
+	// DryRun makes the job report changes of the file instead of applying them, see GetJobChanges
+	DryRun bool `json:"dry_run"`
+	// Mode replace removes offers missing from the file, but no more than MaxRemovePercent of them
+	Mode             string `json:"mode"`
+	MaxRemovePercent *int   `json:"max_remove_percent"`
+	// Format, Delimiter and Encoding describe how to read uploaded file, see models.SourceOptions
+	Format    string `json:"format"`
+	Delimiter string `json:"delimiter"`
+	Encoding  string `json:"encoding"`
+	// ColumnMapping maps columns offer_id, name, price, quantity, available to header names of the file
+	ColumnMapping map[string]string `json:"column_mapping"`
+	// CallbackUrl receives final status of the job, see WebhookSignatureHeader
+	CallbackUrl string `json:"callback_url"`
 }
 
-func NewSalesController(DB *sql.DB) SalesController {
+func NewSalesController(DB *sql.DB, workerConfig WorkerConfig, uploadConfig UploadConfig, authConfig AuthConfig) SalesController {
 	sales := &models.Sales{DB: DB}
+	jobs := &models.UploadJobs{DB: DB}
 	return &salesController{
-		Sales:  sales,
-		Worker: NewWorker(sales),
+		Sales:        sales,
+		Jobs:         jobs,
+		Worker:       NewWorker(sales, jobs, workerConfig),
+		UploadConfig: uploadConfig,
+		AuthConfig:   authConfig,
 	}
 }
 
 func (s *salesController) GetSales(w http.ResponseWriter, r *http.Request) {
 	filter := models.Filter{}
 
-	sellerIdStr := r.URL.Query().Get("seller_id")
-	if sellerIdStr != "" {
-		sellerId, err := strconv.Atoi(sellerIdStr)
+	sellerIds, err := parseIntListParam(r, "seller_id")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"seller_id_str": r.URL.Query()["seller_id"],
+		}).Warningln("Error parsing seller_id from string")
+
+		writeError(w, http.StatusBadRequest, "Invalid value of seller_id, must be integer or comma separated list of integers")
+		return
+	}
+	filter.SellerIds = sellerIds
+
+	offerIds, err := parseIntListParam(r, "offer_id")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":        err,
+			"offer_id_str": r.URL.Query()["offer_id"],
+		}).Warningln("Error parsing offer_id from string")
+
+		writeError(w, http.StatusBadRequest, "Invalid value of offer_id, must be integer or comma separated list of integers")
+		return
+	}
+	filter.OfferIds = offerIds
+
+	bounds := []struct {
+		name  string
+		value **int
+	}{
+		{"price_min", &filter.PriceMin},
+		{"price_max", &filter.PriceMax},
+		{"quantity_min", &filter.QuantityMin},
+		{"quantity_max", &filter.QuantityMax},
+	}
+	for _, bound := range bounds {
+		boundStr := r.URL.Query().Get(bound.name)
+		if boundStr == "" {
+			continue
+		}
+		value, err := strconv.Atoi(boundStr)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"seller_id_str": sellerIdStr,
-			}).Warningln("Error parsing seller_id from string")
-
-			w.WriteHeader(http.StatusBadRequest)
-			respError := models.Error{
-				Message: "Invalid value of seller_id, must be integer",
-				Code:    http.StatusBadRequest,
-			}
-			respJson, _ := json.Marshal(respError)
-			w.Write(respJson)
+			writeError(w, http.StatusBadRequest, "Invalid value of "+bound.name+", must be integer")
 			return
-		} else {
-			filter.SellerId = &sellerId
 		}
+		*bound.value = &value
 	}
 
-	offerIdStr := r.URL.Query().Get("offer_id")
+	nameQuery := r.URL.Query().Get("query")
+	if nameQuery != "" {
+		filter.Query = &nameQuery
+	}
+	filter.SearchMode = r.URL.Query().Get("search_mode")
 
-	if offerIdStr != "" {
-		offerId, err := strconv.Atoi(sellerIdStr)
+	if includeStr := r.URL.Query().Get("include_unavailable"); includeStr != "" {
+		filter.IncludeUnavailable, err = strconv.ParseBool(includeStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid value of include_unavailable, must be boolean")
+			return
+		}
+	}
+
+	// relevance makes sense only for full-text and fuzzy search
+	searchByRelevance := filter.Query != nil && (filter.SearchMode == models.SearchFullText || filter.SearchMode == models.SearchFuzzy)
+
+	limit, err := parseIntParam(r, "limit", DefaultPageLimit)
+	if err != nil || limit <= 0 || limit > MaxPageLimit {
+		writeError(w, http.StatusBadRequest, "Invalid value of limit, must be integer from 1 to 1000")
+		return
+	}
+	filter.Limit = limit
+
+	offset, err := parseIntParam(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid value of offset, must be non-negative integer")
+		return
+	}
+	filter.Offset = offset
+
+	filter.Sort = r.URL.Query().Get("sort")
+	if filter.Sort == "" && searchByRelevance {
+		filter.Sort = models.SortByRelevance
+	} else if filter.Sort == "" {
+		filter.Sort = models.SortByOfferId
+	} else if !models.IsValidSort(filter.Sort) {
+		writeError(w, http.StatusBadRequest, "Invalid value of sort, must be one of offer_id, name, price, quantity, relevance")
+		return
+	}
+
+	switch r.URL.Query().Get("order") {
+	case "":
+		// the most relevant sales go first by default
+		filter.SortDesc = filter.Sort == models.SortByRelevance
+	case "asc":
+		filter.SortDesc = false
+	case "desc":
+		filter.SortDesc = true
+	default:
+		writeError(w, http.StatusBadRequest, "Invalid value of order, must be asc or desc")
+		return
+	}
+
+	cursorStr := r.URL.Query().Get("cursor")
+	if cursorStr != "" {
+		cursor, err := models.DecodeCursor(cursorStr)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"error":        err,
-				"offer_id_str": offerIdStr,
-			}).Warningln("Error parsing offer_id from string")
-
-			w.WriteHeader(http.StatusBadRequest)
-			respError := models.Error{
-				Message: "Invalid value of offer_id, must be integer",
-				Code:    http.StatusBadRequest,
-			}
-			respJson, _ := json.Marshal(respError)
-			w.Write(respJson)
+				"error":  err,
+				"cursor": cursorStr,
+			}).Warningln("Error decoding cursor")
+
+			writeError(w, http.StatusBadRequest, "Invalid value of cursor")
 			return
-		} else {
-			filter.OfferId = &offerId
 		}
+		// cursor is only valid for the order it was created for
+		filter.Cursor = cursor
+		filter.Sort = cursor.Sort
+		filter.SortDesc = cursor.SortDesc
 	}
 
-	nameQuery := r.URL.Query().Get("query")
-	if nameQuery != "" {
-		filter.Query = &nameQuery
+	if filterErr := filter.Validate(); filterErr != nil {
+		writeError(w, filterErr.Code, filterErr.Message)
+		return
 	}
 
-	sales, err := s.Sales.FindByFilter(filter)
+	page, err := s.Sales.FindPage(r.Context(), filter)
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -104,11 +216,71 @@ func (s *salesController) GetSales(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respJson, _ := json.Marshal(sales)
+	respJson, _ := json.Marshal(page)
 	w.Write(respJson)
 }
 
+type historyPage struct {
+	Items []models.SaleAudit `json:"items"`
+	Total int                `json:"total"`
+}
+
+// GetSaleHistory returns changes of the offer starting from the latest one,
+// history is kept after the offer is deleted and purged
+func (s *salesController) GetSaleHistory(w http.ResponseWriter, r *http.Request) {
+	sellerId, err := parseIntVar(r, "seller_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of seller_id, must be integer")
+		return
+	}
+	offerId, err := parseIntVar(r, "offer_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value of offer_id, must be integer")
+		return
+	}
+
+	limit, err := parseIntParam(r, "limit", DefaultPageLimit)
+	if err != nil || limit <= 0 || limit > MaxPageLimit {
+		writeError(w, http.StatusBadRequest, "Invalid value of limit, must be integer from 1 to 1000")
+		return
+	}
+
+	offset, err := parseIntParam(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid value of offset, must be non-negative integer")
+		return
+	}
+
+	history, total, err := s.Sales.FindHistory(r.Context(), sellerId, offerId, limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error getting history of offer")
+		return
+	}
+	if total == 0 {
+		writeError(w, http.StatusNotFound, "Offer not found")
+		return
+	}
+
+	writeJson(w, historyPage{
+		Items: history,
+		Total: total,
+	})
+}
+
+// Upload starts job for file given by link in JSON body, or for file sent directly
+// as multipart/form-data or as raw request body of a file content type.
+// Body of any other content type is decoded as JSON, clients often don't set it.
 func (s *salesController) Upload(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		s.uploadMultipart(w, r)
+		return
+	}
+	if models.IsFileContentType(mediaType) {
+		s.uploadRaw(w, r, mediaType)
+		return
+	}
+
 	var req uploadRequest
 
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -129,7 +301,106 @@ func (s *salesController) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jobId := s.Worker.StartJob(req.ExcelUrl, req.SellerId)
+	source := models.SourceOptions{
+		Format:    req.Format,
+		Delimiter: req.Delimiter,
+		Encoding:  req.Encoding,
+
+		ColumnMapping: req.ColumnMapping,
+	}
+	if sourceErr := source.Validate(); sourceErr != nil {
+		writeError(w, sourceErr.Code, sourceErr.Message)
+		return
+	}
+	if callbackErr := models.ValidateCallbackUrl(req.CallbackUrl); callbackErr != nil {
+		writeError(w, callbackErr.Code, callbackErr.Message)
+		return
+	}
+	if modeErr := models.ValidateMode(req.Mode, req.MaxRemovePercent); modeErr != nil {
+		writeError(w, modeErr.Code, modeErr.Message)
+		return
+	}
+	if req.ExcelUrl == "" {
+		writeError(w, http.StatusBadRequest, "Invalid value of path, must be link to the file")
+		return
+	}
+
+	s.startJob(w, r, JobOptions{
+		Url:         req.ExcelUrl,
+		SellerId:    req.SellerId,
+		Source:      source,
+		Atomic:      req.Atomic,
+		DryRun:      req.DryRun,
+		CallbackUrl: req.CallbackUrl,
+
+		Mode:             req.Mode,
+		MaxRemovePercent: req.MaxRemovePercent,
+	})
+}
+
+// startJob passes options to worker and writes id of started job, or id of the job started earlier
+// with the same idempotency key
+func (s *salesController) startJob(w http.ResponseWriter, r *http.Request, options JobOptions) {
+	options.IdempotencyKey = r.Header.Get(IdempotencyKeyHeader)
+	if len(options.IdempotencyKey) > maxIdempotencyKeyLength {
+		s.removeUpload(options.FilePath)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid value of %s, must be at most %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+		return
+	}
+
+	jobId, err := s.Worker.StartJob(options)
+
+	if err == ErrJobExists {
+		log.WithFields(log.Fields{
+			"job_id":    jobId,
+			"seller_id": options.SellerId,
+		}).Infoln("Upload with the same idempotency key was already started")
+
+		// the file of the repeated upload isn't needed, the earlier job has its own one
+		s.removeUpload(options.FilePath)
+		w.Header().Set("Idempotent-Replayed", "true")
+		err = nil
+	}
+
+	if err == ErrQueueFull {
+		log.WithFields(log.Fields{
+			"url":       options.Url,
+			"file_path": options.FilePath,
+			"seller_id": options.SellerId,
+		}).Warningln("Upload queue is full")
+
+		s.removeUpload(options.FilePath)
+
+		respError := models.Error{
+			Code:    http.StatusServiceUnavailable,
+			Message: "Too many uploads are being processed, try again later",
+		}
+		respJson, _ := json.Marshal(respError)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(respJson)
+		return
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"url":       options.Url,
+			"file_path": options.FilePath,
+			"seller_id": options.SellerId,
+		}).Errorln("Error starting upload job")
+
+		s.removeUpload(options.FilePath)
+
+		respError := models.Error{
+			Code:    http.StatusInternalServerError,
+			Message: "Error starting upload job",
+		}
+		respJson, _ := json.Marshal(respError)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(respJson)
+		return
+	}
 
 	respJson, _ := json.Marshal(struct {
 		JobId string `json:"job_id"`
@@ -140,17 +411,31 @@ func (s *salesController) Upload(w http.ResponseWriter, r *http.Request) {
 
 func (s *salesController) GetJobStatus(w http.ResponseWriter, r *http.Request) {
 	jobId := r.URL.Query().Get("job_id")
-	q := s.Worker.GetJobStatus(jobId)
-	if !q.Ready {
-		q.UploadResult = nil
-		q.Error = nil
-	} else {
-		s.Worker.FinishJob(jobId)
+	if s.findSellerJob(w, r, jobId) == nil {
+		return
 	}
+
+	// finished jobs are kept until they expire, see WorkerConfig.JobRetention
+	q, err := s.Worker.GetJobStatus(jobId)
+	if err == ErrJobNotFound {
+		writeError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"job_id": jobId,
+		}).Errorln("Error getting job status")
+
+		writeError(w, http.StatusInternalServerError, "Error getting job status")
+		return
+	}
+
 	respJson, _ := json.Marshal(q)
 	w.Write(respJson)
 }
 
 func (s *salesController) Close() {
+	s.Worker.Close()
 	s.Sales.Close()
 }
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSellerRequest(method string, target string, sellerId int) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+SellerToken("secret", sellerId))
+	return r
+}
+
+func TestGetJobStatus_Idempotent(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	s := &salesController{
+		Jobs:       jobs,
+		Worker:     NewWorker(nil, jobs, WorkerConfig{QueueSize: 1}),
+		AuthConfig: AuthConfig{SellerTokenSecret: "secret"},
+	}
+	defer s.Worker.Close()
+
+	finishedAt := time.Now()
+	jobs.AddJob(models.UploadJob{JobId: "done", SellerId: 1, State: models.JobDone, FinishedAt: &finishedAt})
+
+	// finished job is returned on every read until it expires
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		s.GetJobStatus(w, newSellerRequest(http.MethodGet, "/get_status?job_id=done&seller_id=1", 1))
+
+		var status UploadStatus
+		json.Unmarshal(w.Body.Bytes(), &status)
+		if w.Code != http.StatusOK || !status.Ready || status.State != models.JobDone {
+			t.Errorf("Invalid status of finished job on read %d: %d %s", i+1, w.Code, w.Body.String())
+		}
+	}
+
+	cases := []struct {
+		name     string
+		query    string
+		sellerId int
+		status   int
+	}{
+		{"unknown job", "?job_id=unknown&seller_id=1", 1, http.StatusNotFound},
+		// job of another seller looks like an unknown one
+		{"other seller", "?job_id=done&seller_id=2", 2, http.StatusNotFound},
+		{"no seller_id", "?job_id=done", 1, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		s.GetJobStatus(w, newSellerRequest(http.MethodGet, "/get_status"+c.query, c.sellerId))
+
+		var respErr models.Error
+		json.Unmarshal(w.Body.Bytes(), &respErr)
+		if w.Code != c.status || respErr.Code != c.status {
+			t.Errorf("%s: expected %d, got %d %s", c.name, c.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestJobAccess_SellerBinding(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	s := &salesController{
+		Jobs:       jobs,
+		Worker:     NewWorker(nil, jobs, WorkerConfig{QueueSize: 1}),
+		AuthConfig: AuthConfig{SellerTokenSecret: "secret"},
+	}
+	defer s.Worker.Close()
+
+	jobId, err := s.Worker.StartJob(JobOptions{Url: "http://localhost/offers.xlsx", SellerId: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	// ids are random UUIDs, so they can't be guessed from ids of other jobs
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(jobId) {
+		t.Errorf("Job id %q isn't a random UUID", jobId)
+	}
+
+	cases := []struct {
+		name          string
+		sellerId      string
+		authorization string
+		status        int
+	}{
+		{"owner", "1", "Bearer " + SellerToken("secret", 1), http.StatusOK},
+		{"no token", "1", "", http.StatusUnauthorized},
+		{"token of other seller", "1", "Bearer " + SellerToken("secret", 2), http.StatusUnauthorized},
+		{"token signed with other secret", "1", "Bearer " + SellerToken("other", 1), http.StatusUnauthorized},
+		// the job isn't found for another seller even with a valid token
+		{"other seller", "2", "Bearer " + SellerToken("secret", 2), http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/get_status?job_id="+jobId+"&seller_id="+c.sellerId, nil)
+		r.Header.Set("Authorization", c.authorization)
+		s.GetJobStatus(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d %s", c.name, c.status, w.Code, w.Body.String())
+		}
+
+		if c.status == http.StatusOK {
+			continue
+		}
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodDelete, "/jobs/"+jobId+"?seller_id="+c.sellerId, nil)
+		r.Header.Set("Authorization", c.authorization)
+		s.CancelJob(w, mux.SetURLVars(r, map[string]string{"id": jobId}))
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d on cancel, got %d %s", c.name, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	status, _ := s.Worker.GetJobStatus(jobId)
+	if status.State != models.JobQueued {
+		t.Errorf("Job must be cancelled only by its seller, got state %s", status.State)
+	}
+
+	// without a secret no token is valid
+	s.AuthConfig.SellerTokenSecret = ""
+	w := httptest.NewRecorder()
+	s.GetJobStatus(w, newSellerRequest(http.MethodGet, "/get_status?job_id="+jobId+"&seller_id=1", 1))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d without secret, got %d %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+}
+
+func TestGetSaleHistory(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	defer db.Close()
+	s := &salesController{Sales: &models.Sales{DB: db}}
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM sales_audit`).WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(`SELECT (.+) FROM sales_audit`).WithArgs(1, 2, DefaultPageLimit, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"audit_id", "action", "job_id", "changed_at", "old_sale", "new_sale"}))
+
+	cases := []struct {
+		name     string
+		sellerId string
+		offerId  string
+		query    string
+		status   int
+	}{
+		{"unknown offer", "1", "2", "", http.StatusNotFound},
+		{"invalid seller_id", "seller", "2", "", http.StatusBadRequest},
+		{"invalid limit", "1", "2", "?limit=0", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/offers/"+c.sellerId+"/"+c.offerId+"/history"+c.query, nil)
+		s.GetSaleHistory(w, mux.SetURLVars(r, map[string]string{"seller_id": c.sellerId, "offer_id": c.offerId}))
+
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d %s", c.name, c.status, w.Code, w.Body.String())
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
+
+func TestListJobs_HidesSecrets(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	s := &salesController{Jobs: jobs, AuthConfig: AuthConfig{SellerTokenSecret: "secret"}}
+
+	jobs.AddJob(models.UploadJob{JobId: "job", SellerId: 1, State: models.JobQueued, CallbackUrl: "http://localhost/callback", IdempotencyKey: "key"})
+
+	w := httptest.NewRecorder()
+	s.ListJobs(w, newSellerRequest(http.MethodGet, "/jobs?seller_id=1", 1))
+
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `"job_id":"job"`) {
+		t.Fatalf("Invalid response %d: %s", w.Code, body)
+	}
+	if strings.Contains(body, "callback") || strings.Contains(body, "key") {
+		t.Errorf("Callback url and idempotency key must not be listed: %s", body)
+	}
+
+	// ids of jobs aren't listed to other sellers
+	for _, authorization := range []string{"", "Bearer " + SellerToken("secret", 2)} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/jobs?seller_id=1", nil)
+		r.Header.Set("Authorization", authorization)
+		s.ListJobs(w, r)
+
+		if w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), `"job_id"`) {
+			t.Errorf("Expected %d for authorization %q, got %d %s", http.StatusUnauthorized, authorization, w.Code, w.Body.String())
+		}
+	}
+}
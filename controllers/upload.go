@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"github.com/fertilewaif/avito-mx-backend-test/utils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// maxFormFieldSize limits size of every non-file field of multipart upload
+const maxFormFieldSize = 64 * 1024
+
+var errUploadTooLarge = errors.New("uploaded file is too large")
+
+// UploadConfig describes how files sent directly to /upload are stored
+type UploadConfig struct {
+	// Dir is the directory where uploaded files are kept
+	Dir string
+	// MaxSize is the maximum size of uploaded file in bytes
+	MaxSize int64
+}
+
+// uploadMultipart handles multipart/form-data upload, file is taken from "file" field
+// and the other fields have the same names as fields of uploadRequest
+func (s *salesController) uploadMultipart(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error parsing multipart request body")
+		return
+	}
+
+	// form fields take precedence over query parameters
+	values := r.URL.Query()
+	var filePath, fileFormat string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warningln("Error reading multipart request body")
+
+			s.removeUpload(filePath)
+			writeError(w, http.StatusBadRequest, "Error parsing multipart request body")
+			return
+		}
+
+		if part.FormName() != "file" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			part.Close()
+			if err != nil {
+				s.removeUpload(filePath)
+				writeError(w, http.StatusBadRequest, "Error parsing multipart request body")
+				return
+			}
+			values.Set(part.FormName(), string(value))
+			continue
+		}
+
+		if filePath != "" {
+			part.Close()
+			s.removeUpload(filePath)
+			writeError(w, http.StatusBadRequest, "Only one file can be uploaded at once")
+			return
+		}
+
+		fileFormat = models.DetectFormat(part.Header.Get("Content-Type"), part.FileName())
+		filePath, err = s.saveUpload(part)
+		part.Close()
+		if err != nil {
+			s.writeSaveError(w, err)
+			return
+		}
+	}
+
+	if filePath == "" {
+		writeError(w, http.StatusBadRequest, "Uploaded file must be sent in field file")
+		return
+	}
+
+	options, optionsErr := parseUploadOptions(values, fileFormat)
+	if optionsErr != nil {
+		s.removeUpload(filePath)
+		writeError(w, optionsErr.Code, optionsErr.Message)
+		return
+	}
+	options.FilePath = filePath
+
+	s.startJob(w, r, options)
+}
+
+// uploadRaw handles file sent as request body, options are taken from query parameters
+func (s *salesController) uploadRaw(w http.ResponseWriter, r *http.Request, contentType string) {
+	options, optionsErr := parseUploadOptions(r.URL.Query(), models.DetectFormat(contentType, ""))
+	if optionsErr != nil {
+		writeError(w, optionsErr.Code, optionsErr.Message)
+		return
+	}
+
+	filePath, err := s.saveUpload(r.Body)
+	if err != nil {
+		s.writeSaveError(w, err)
+		return
+	}
+	options.FilePath = filePath
+
+	s.startJob(w, r, options)
+}
+
+// parseUploadOptions reads job options of direct upload, format is used when it isn't given explicitly
+func parseUploadOptions(values url.Values, format string) (JobOptions, *models.Error) {
+	options := JobOptions{}
+
+	sellerId, err := strconv.Atoi(values.Get("seller_id"))
+	if err != nil {
+		return options, &models.Error{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid value of seller_id, must be integer",
+		}
+	}
+	options.SellerId = sellerId
+
+	if atomicStr := values.Get("atomic"); atomicStr != "" {
+		options.Atomic, err = strconv.ParseBool(atomicStr)
+		if err != nil {
+			return options, &models.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Invalid value of atomic, must be boolean",
+			}
+		}
+	}
+
+	if dryRunStr := values.Get("dry_run"); dryRunStr != "" {
+		options.DryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			return options, &models.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Invalid value of dry_run, must be boolean",
+			}
+		}
+	}
+
+	options.Mode = values.Get("mode")
+	if percentStr := values.Get("max_remove_percent"); percentStr != "" {
+		maxRemovePercent, err := strconv.Atoi(percentStr)
+		if err != nil {
+			return options, &models.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Invalid value of max_remove_percent, must be integer from 0 to 100",
+			}
+		}
+		options.MaxRemovePercent = &maxRemovePercent
+	}
+	if modeErr := models.ValidateMode(options.Mode, options.MaxRemovePercent); modeErr != nil {
+		return options, modeErr
+	}
+
+	options.Source = models.SourceOptions{
+		Format:    values.Get("format"),
+		Delimiter: values.Get("delimiter"),
+		Encoding:  values.Get("encoding"),
+	}
+	if options.Source.Format == "" {
+		options.Source.Format = format
+	}
+
+	if mappingStr := values.Get("column_mapping"); mappingStr != "" {
+		err = json.Unmarshal([]byte(mappingStr), &options.Source.ColumnMapping)
+		if err != nil {
+			return options, &models.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Invalid value of column_mapping, must be JSON object",
+			}
+		}
+	}
+
+	if sourceErr := options.Source.Validate(); sourceErr != nil {
+		return options, sourceErr
+	}
+
+	options.CallbackUrl = values.Get("callback_url")
+	return options, models.ValidateCallbackUrl(options.CallbackUrl)
+}
+
+// saveUpload writes body to a new file in the uploads directory, nothing is kept if it fails
+func (s *salesController) saveUpload(body io.Reader) (string, error) {
+	filePath := filepath.Join(s.UploadConfig.Dir, utils.RandStringRunes(40))
+	file, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// one extra byte shows that body exceeds the limit
+	written, err := io.Copy(file, io.LimitReader(body, s.UploadConfig.MaxSize+1))
+	file.Close()
+	if err == nil && written > s.UploadConfig.MaxSize {
+		err = errUploadTooLarge
+	}
+
+	if err != nil {
+		s.removeUpload(filePath)
+		return "", err
+	}
+	return filePath, nil
+}
+
+func (s *salesController) writeSaveError(w http.ResponseWriter, err error) {
+	if err == errUploadTooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Uploaded file is too large, maximum size is %d bytes", s.UploadConfig.MaxSize))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"error":       err,
+		"uploads_dir": s.UploadConfig.Dir,
+	}).Errorln("Error saving uploaded file")
+
+	writeError(w, http.StatusInternalServerError, "Error saving uploaded file")
+}
+
+// removeUpload deletes uploaded file of a job which wasn't started
+func (s *salesController) removeUpload(filePath string) {
+	if filePath == "" {
+		return
+	}
+
+	err := os.Remove(filePath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"file_path": filePath,
+		}).Errorln("Error removing uploaded file")
+	}
+}
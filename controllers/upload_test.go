@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"bytes"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeWorker keeps options of started jobs instead of processing them
+type fakeWorker struct {
+	started []JobOptions
+}
+
+func (f *fakeWorker) StartJob(options JobOptions) (string, error) {
+	f.started = append(f.started, options)
+	return "job", nil
+}
+
+func (f *fakeWorker) GetJobStatus(jobId string) (UploadStatus, error) {
+	return UploadStatus{}, ErrJobNotFound
+}
+
+func (f *fakeWorker) Subscribe(jobId string) (<-chan UploadStatus, func()) {
+	return make(chan UploadStatus), func() {}
+}
+
+func (f *fakeWorker) CancelJob(jobId string) error {
+	return nil
+}
+
+func (f *fakeWorker) Close() {}
+
+func newUploadController(t *testing.T, maxSize int64) (*salesController, *fakeWorker) {
+	worker := &fakeWorker{}
+	return &salesController{
+		Worker: worker,
+		UploadConfig: UploadConfig{
+			Dir:     t.TempDir(),
+			MaxSize: maxSize,
+		},
+	}, worker
+}
+
+func TestUpload_Multipart(t *testing.T) {
+	s, worker := newUploadController(t, 1024)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("seller_id", "7")
+	writer.WriteField("delimiter", ";")
+	writer.WriteField("column_mapping", `{"price": "Цена"}`)
+	fileWriter, _ := writer.CreateFormFile("file", "offers.csv")
+	fileWriter.Write([]byte("1;offer;100;1;true\n"))
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.Upload(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d: %s", w.Code, w.Body.String())
+	}
+	if len(worker.started) != 1 {
+		t.Fatalf("Expected one started job, got %d", len(worker.started))
+	}
+
+	options := worker.started[0]
+	if options.SellerId != 7 || options.Url != "" || options.Source.Format != models.FormatCsv ||
+		options.Source.Delimiter != ";" || options.Source.ColumnMapping[models.ColumnPrice] != "Цена" {
+		t.Errorf("Invalid job options: %+v", options)
+	}
+
+	content, err := ioutil.ReadFile(options.FilePath)
+	if err != nil {
+		t.Fatalf("Error reading uploaded file: %s", err.Error())
+	}
+	if string(content) != "1;offer;100;1;true\n" {
+		t.Errorf("Invalid content of uploaded file: %q", content)
+	}
+}
+
+func TestUpload_Raw(t *testing.T) {
+	s, worker := newUploadController(t, 1024)
+
+	r := httptest.NewRequest(http.MethodPost, "/upload?seller_id=3&atomic=true&dry_run=1", bytes.NewBufferString("1,offer,100,1,true\n"))
+	r.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	s.Upload(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d: %s", w.Code, w.Body.String())
+	}
+	options := worker.started[0]
+	if options.SellerId != 3 || !options.Atomic || !options.DryRun || options.Source.Format != models.FormatCsv || options.FilePath == "" {
+		t.Errorf("Invalid job options: %+v", options)
+	}
+}
+
+func TestUpload_JsonWithoutJsonContentType(t *testing.T) {
+	s, worker := newUploadController(t, 1024)
+
+	// curl -d sends JSON as application/x-www-form-urlencoded
+	body := `{"seller_id": 5, "path": "http://localhost/offers.xlsx"}`
+	r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.Upload(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d: %s", w.Code, w.Body.String())
+	}
+	options := worker.started[0]
+	if options.SellerId != 5 || options.Url != "http://localhost/offers.xlsx" || options.FilePath != "" {
+		t.Errorf("Invalid job options: %+v", options)
+	}
+}
+
+func TestUpload_EmptyPath(t *testing.T) {
+	s, worker := newUploadController(t, 1024)
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBufferString(`{"seller_id": 5}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Upload(w, r)
+
+	if w.Code != http.StatusBadRequest || len(worker.started) != 0 {
+		t.Errorf("Job without file must be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUpload_Errors(t *testing.T) {
+	cases := []struct {
+		name   string
+		query  string
+		body   string
+		status int
+	}{
+		{"too large", "?seller_id=1", "1,offer,100,1,true\n", http.StatusRequestEntityTooLarge},
+		{"no seller_id", "", "1\n", http.StatusBadRequest},
+		{"invalid format", "?seller_id=1&format=xls", "1\n", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		s, worker := newUploadController(t, 10)
+
+		r := httptest.NewRequest(http.MethodPost, "/upload"+c.query, bytes.NewBufferString(c.body))
+		r.Header.Set("Content-Type", "text/csv")
+		w := httptest.NewRecorder()
+		s.Upload(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%s: invalid status code, expected %d, got %d", c.name, c.status, w.Code)
+		}
+		if len(worker.started) != 0 {
+			t.Errorf("%s: job must not be started", c.name)
+		}
+
+		files, _ := ioutil.ReadDir(s.UploadConfig.Dir)
+		if len(files) != 0 {
+			t.Errorf("%s: uploaded file must be removed", c.name)
+		}
+	}
+}
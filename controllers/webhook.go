@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// WebhookSignatureHeader carries "sha256=" followed by hex encoded HMAC-SHA256 of request body,
+// made with WorkerConfig.WebhookSecret
+const WebhookSignatureHeader = "X-Signature-SHA256"
+
+const (
+	webhookTimeout = 10 * time.Second
+	// maxWebhookResponseSize limits how much of callback response is read before the connection is reused
+	maxWebhookResponseSize = 64 * 1024
+)
+
+// deliverWebhook posts final status of the job to its callback url, retrying with exponential backoff
+func (w *worker) deliverWebhook(jobId string, callbackUrl string, status UploadStatus) {
+	defer w.deliveries.Done()
+
+	body, _ := json.Marshal(status)
+	backoff := w.config.WebhookBackoff
+	for attempt := 1; ; attempt++ {
+		delivery := w.sendWebhook(callbackUrl, body)
+		delivery.Attempt = attempt
+
+		err := w.jobs.AddDelivery(jobId, delivery)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"job_id": jobId,
+			}).Errorln("Error saving webhook delivery")
+		}
+
+		if delivery.Succeeded() {
+			return
+		}
+		if attempt >= w.config.WebhookAttempts || !retryableDelivery(delivery) {
+			log.WithFields(log.Fields{
+				"job_id":       jobId,
+				"callback_url": callbackUrl,
+				"attempts":     attempt,
+				"error":        delivery.Error,
+			}).Warningln("Webhook wasn't delivered")
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-w.done:
+			// worker is closed, remaining attempts are dropped
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (w *worker) sendWebhook(callbackUrl string, body []byte) models.WebhookDelivery {
+	delivery := models.WebhookDelivery{SentAt: time.Now()}
+
+	request, err := http.NewRequest(http.MethodPost, callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if w.config.WebhookSecret != "" {
+		request.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(w.config.WebhookSecret, body))
+	}
+
+	response, err := w.webhookClient.Do(request)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, maxWebhookResponseSize))
+	response.Body.Close()
+
+	delivery.StatusCode = response.StatusCode
+	if !delivery.Succeeded() {
+		delivery.Error = "callback responded with " + response.Status
+	}
+	return delivery
+}
+
+// retryableDelivery reports whether failed delivery may succeed later
+func retryableDelivery(delivery models.WebhookDelivery) bool {
+	return delivery.StatusCode == 0 || delivery.StatusCode >= 500 ||
+		delivery.StatusCode == http.StatusRequestTimeout || delivery.StatusCode == http.StatusTooManyRequests
+}
+
+// SignWebhook returns hex encoded HMAC-SHA256 of body, receivers use it to check WebhookSignatureHeader
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
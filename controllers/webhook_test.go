@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWorker_Webhook(t *testing.T) {
+	var requests int
+	var received UploadStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(WebhookSignatureHeader) != "sha256="+SignWebhook("secret", body) {
+			t.Errorf("Invalid signature %q", r.Header.Get(WebhookSignatureHeader))
+		}
+		// the first attempt fails to check retries
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	jobs := models.NewMemoryJobStore()
+	w := NewWorker(nil, jobs, WorkerConfig{
+		QueueSize:       1,
+		WebhookSecret:   "secret",
+		WebhookAttempts: 3,
+		WebhookBackoff:  time.Millisecond,
+	}).(*worker)
+
+	jobId, err := w.StartJob(JobOptions{Url: "http://localhost/first.xlsx", SellerId: 1, CallbackUrl: server.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	job, _ := jobs.FindById(jobId)
+	w.failJob(job, &models.Error{Code: 400, Message: "test error"})
+	w.deliveries.Wait()
+
+	if received.JobId != jobId || received.State != models.JobFailed || received.Error == nil {
+		t.Errorf("Invalid delivered status: %+v", received)
+	}
+
+	status, _ := w.GetJobStatus(jobId)
+	if len(status.Deliveries) != 2 {
+		t.Fatalf("Expected 2 deliveries, got %+v", status.Deliveries)
+	}
+	if status.Deliveries[0].StatusCode != http.StatusServiceUnavailable || status.Deliveries[0].Error == "" {
+		t.Errorf("Invalid failed delivery: %+v", status.Deliveries[0])
+	}
+	if !status.Deliveries[1].Succeeded() || status.Deliveries[1].Attempt != 2 {
+		t.Errorf("Invalid successful delivery: %+v", status.Deliveries[1])
+	}
+}
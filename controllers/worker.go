@@ -1,75 +1,346 @@
 package controllers
 
 import (
-	"crypto/md5"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/fertilewaif/avito-mx-backend-test/models"
 	"github.com/fertilewaif/avito-mx-backend-test/utils"
 	log "github.com/sirupsen/logrus"
-	"github.com/tealeg/xlsx/v3"
 	"io"
 	"net/http"
 	"os"
-	"strconv"
 	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned by StartJob when there is no room for a new job in the queue
+	ErrQueueFull = errors.New("upload queue is full")
+	// ErrJobNotFound is returned for unknown jobs and for jobs finished more than WorkerConfig.JobRetention ago
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobFinished is returned by CancelJob for jobs which can't be cancelled anymore
+	ErrJobFinished = errors.New("job is already finished")
+	// ErrJobExists is returned by StartJob together with id of the job started earlier with the same idempotency key
+	ErrJobExists = errors.New("job with the same idempotency key already exists")
 )
 
 type Worker interface {
-	StartJob(url string, sellerId int) string
-	GetJobStatus(jobId string) UploadStatus
-	FinishJob(jobId string)
+	StartJob(options JobOptions) (string, error)
+	// GetJobStatus returns ErrJobNotFound for unknown and expired jobs, reading status doesn't change it
+	GetJobStatus(jobId string) (UploadStatus, error)
+	// Subscribe returns channel receiving status of the job on every change, it is closed after the final status.
+	// Slow receivers get only the latest status. The returned function stops updates.
+	Subscribe(jobId string) (<-chan UploadStatus, func())
+	// CancelJob stops the job, a running job stops at the next row keeping changes applied so far
+	// unless it is atomic
+	CancelJob(jobId string) error
+	Close()
 }
 
 type UploadStatus struct {
-	Ready        bool                 `json:"ready"`
-	UploadResult *models.UploadResult `json:"upload_result,omitempty"`
-	Error        *models.Error        `json:"error,omitempty"`
+	JobId         string               `json:"job_id,omitempty"`
+	Ready         bool                 `json:"ready"`
+	DryRun        bool                 `json:"dry_run,omitempty"`
+	State         models.JobState      `json:"state,omitempty"`
+	QueuePosition int64                `json:"queue_position,omitempty"`
+	Progress      *UploadProgress      `json:"progress,omitempty"`
+	UploadResult  *models.UploadResult `json:"upload_result,omitempty"`
+	Error         *models.Error        `json:"error,omitempty"`
+	// Deliveries are attempts to send the final status to callback url of the job
+	Deliveries []models.WebhookDelivery `json:"deliveries,omitempty"`
+}
+
+type JobOptions struct {
+	Url string
+	// FilePath is set instead of Url for files uploaded directly, such files aren't downloaded
+	FilePath string
+	SellerId int
+	Source   models.SourceOptions
+	// Atomic makes the whole file to be applied in a single transaction
+	Atomic bool
+	// DryRun makes the job only find changes of the file without applying them
+	DryRun bool
+	// Mode is models.ModeMerge or models.ModeReplace, merge is used if it is empty
+	Mode string
+	// MaxRemovePercent overrides WorkerConfig.MaxRemovePercent for the job
+	MaxRemovePercent *int
+	// CallbackUrl receives the final status of the job
+	CallbackUrl string
+	// IdempotencyKey makes repeated uploads of the seller within WorkerConfig.IdempotencyWindow return the same job
+	IdempotencyKey string
+}
+
+type WorkerConfig struct {
+	// PoolSize is the amount of jobs processed simultaneously
+	PoolSize int
+	// QueueSize is the amount of jobs waiting for a free worker, new jobs are rejected when it is exceeded
+	QueueSize int
+	// WebhookSecret signs statuses sent to callback urls, they aren't signed if it is empty
+	WebhookSecret string
+	// WebhookAttempts is the maximum amount of attempts to deliver status to callback url
+	WebhookAttempts int
+	// WebhookBackoff is the delay before the second attempt, it doubles after every attempt
+	WebhookBackoff time.Duration
+	// JobRetention is how long finished jobs are kept, they are kept forever if it isn't positive
+	JobRetention time.Duration
+	// IdempotencyWindow is how long idempotency keys of started jobs are remembered,
+	// they are remembered while jobs are kept if it isn't positive
+	IdempotencyWindow time.Duration
+	// MaxRemovePercent is the default share of catalogue which upload in replace mode is allowed to remove
+	MaxRemovePercent int
+	// DeletedSalesRetention is how long deleted offers are kept, they are kept forever if it isn't positive
+	DeletedSalesRetention time.Duration
 }
 
 type worker struct {
-	totalJobs int
-	sales     *models.Sales
-	statuses  map[string]*UploadStatus
-	mutex     sync.RWMutex
+	config WorkerConfig
+	sales  *models.Sales
+	jobs   models.JobStore
+	mutex  sync.Mutex
+
+	queue  chan *models.UploadJob
+	closed bool
+	wg     sync.WaitGroup
+	// pending keeps jobs which are being saved, each of them has a place in the queue reserved
+	pending map[string]struct{}
+	// enqueued and dequeued count jobs put into and taken from the queue,
+	// queuePositions keeps value of enqueued for every job waiting in the queue
+	enqueued       int64
+	dequeued       int64
+	queuePositions map[string]int64
+	// progress keeps progress of every running job
+	progress map[string]*jobProgress
+	// cancels keeps functions cancelling context of every running job,
+	// cancelledQueued keeps jobs cancelled while waiting in the queue
+	cancels         map[string]context.CancelFunc
+	cancelledQueued map[string]struct{}
+	// subscribers keeps channels of clients following status of jobs
+	subscribers map[string]map[chan UploadStatus]struct{}
+
+	webhookClient *http.Client
+	deliveries    sync.WaitGroup
+	// done is closed when all jobs are processed after Close, it stops retries of webhooks
+	done chan struct{}
 }
 
-func NewWorker(sales *models.Sales) Worker {
-	return &worker{
-		totalJobs: 0,
-		sales:     sales,
-		statuses:  make(map[string]*UploadStatus),
-		mutex:     sync.RWMutex{},
+// janitorInterval is how often jobs older than WorkerConfig.JobRetention
+// and offers deleted earlier than WorkerConfig.DeletedSalesRetention are purged
+const janitorInterval = time.Hour
+
+// eventInterval limits how often subscribers are notified about progress of a running job
+const eventInterval = 500 * time.Millisecond
+
+// NewWorker starts processing of upload jobs. Only one worker may use a persistent JobStore at a time:
+// the queue is kept in memory, so jobs left queued or running in the store are failed at start.
+func NewWorker(sales *models.Sales, jobs models.JobStore, config WorkerConfig) Worker {
+	if config.WebhookAttempts <= 0 {
+		config.WebhookAttempts = 1
 	}
+
+	w := &worker{
+		config:         config,
+		sales:          sales,
+		jobs:           jobs,
+		mutex:          sync.Mutex{},
+		queue:          make(chan *models.UploadJob, config.QueueSize),
+		queuePositions: make(map[string]int64),
+		pending:        make(map[string]struct{}),
+		progress:       make(map[string]*jobProgress),
+
+		cancels:         make(map[string]context.CancelFunc),
+		cancelledQueued: make(map[string]struct{}),
+		subscribers:     make(map[string]map[chan UploadStatus]struct{}),
+		webhookClient:   &http.Client{Timeout: webhookTimeout},
+		done:            make(chan struct{}),
+	}
+
+	w.failInterrupted()
+	for i := 0; i < config.PoolSize; i++ {
+		w.wg.Add(1)
+		go w.run()
+	}
+	if config.JobRetention > 0 || (sales != nil && config.DeletedSalesRetention > 0) {
+		go w.runJanitor()
+	}
+	return w
 }
 
-func (w *worker) generateJobId() string {
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
+// failInterrupted fails jobs which were queued or running when the service stopped,
+// otherwise they would never finish and never expire. It relies on being the only worker of the store.
+func (w *worker) failInterrupted() {
+	jobs, _, err := w.jobs.FindJobs(models.JobFilter{
+		States: []models.JobState{models.JobQueued, models.JobRunning},
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorln("Error getting interrupted jobs")
+		return
+	}
+
+	for i := range jobs {
+		w.failJob(&jobs[i], &models.Error{
+			Code:    http.StatusInternalServerError,
+			Message: "Job was interrupted by restart",
+		})
+	}
+
+	if len(jobs) > 0 {
+		log.WithFields(log.Fields{
+			"jobs_count": len(jobs),
+		}).Infoln("Interrupted jobs were failed")
+	}
+}
+
+// runJanitor deletes expired jobs and offers until the worker is closed
+func (w *worker) runJanitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if w.config.JobRetention > 0 {
+			w.pruneJobs(now)
+		}
+		if w.sales != nil && w.config.DeletedSalesRetention > 0 {
+			w.purgeSales(now)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// purgeSales deletes offers which were deleted more than DeletedSalesRetention before now
+func (w *worker) purgeSales(now time.Time) {
+	purged, err := w.sales.PurgeDeletedBefore(context.Background(), now.Add(-w.config.DeletedSalesRetention))
+	if err != nil {
+		return
+	}
+
+	if purged > 0 {
+		log.WithFields(log.Fields{
+			"purged_sales": purged,
+		}).Infoln("Purged deleted sales")
+	}
+}
+
+// pruneJobs deletes jobs finished more than JobRetention before now together with their stored files
+func (w *worker) pruneJobs(now time.Time) {
+	filePaths, err := w.jobs.DeleteFinishedBefore(now.Add(-w.config.JobRetention))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorln("Error deleting expired jobs")
+		return
+	}
+
+	for _, filePath := range filePaths {
+		if filePath == "" {
+			continue
+		}
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"error":     err,
+				"file_path": filePath,
+			}).Errorln("Error removing file of expired job")
+		}
+	}
+
+	if len(filePaths) > 0 {
+		log.WithFields(log.Fields{
+			"jobs_count": len(filePaths),
+		}).Infoln("Expired jobs were deleted")
+	}
+}
+
+// run takes jobs from the queue until it is closed
+func (w *worker) run() {
+	defer w.wg.Done()
+
+	for job := range w.queue {
+		now := time.Now()
+		job.State = models.JobRunning
+		job.StartedAt = &now
+		job.UpdatedAt = now
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		w.mutex.Lock()
+		w.dequeued++
+		delete(w.queuePositions, job.JobId)
+		_, cancelled := w.cancelledQueued[job.JobId]
+		delete(w.cancelledQueued, job.JobId)
+		if !cancelled {
+			w.cancels[job.JobId] = cancel
+		}
+		w.notifyQueued()
+		w.mutex.Unlock()
+
+		if cancelled {
+			// job is already finished by CancelJob
+			cancel()
+			continue
+		}
+
+		err := w.jobs.UpdateJob(*job)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"job_id": job.JobId,
+			}).Errorln("Error saving running job")
+		}
+		w.notify(job)
+
+		if job.FilePath != "" {
+			w.processStoredFile(ctx, job.SellerId, job)
+		} else {
+			w.processDownload(ctx, job.Url, job.SellerId, job)
+		}
 
-	w.totalJobs++
-	byteValue := []byte(strconv.Itoa(w.totalJobs))
-	return fmt.Sprintf("%x", md5.Sum(byteValue))
+		w.mutex.Lock()
+		delete(w.cancels, job.JobId)
+		w.mutex.Unlock()
+		cancel()
+	}
 }
 
-func (w *worker) processDownload(url string, sellerId int, uploadStatus *UploadStatus) {
-	download, err := http.Get(url)
+func (w *worker) processDownload(ctx context.Context, url string, sellerId int, job *models.UploadJob) {
+	var download *http.Response
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err == nil {
+		download, err = http.DefaultClient.Do(request)
+	}
 
+	if err != nil && ctx.Err() != nil {
+		w.finishJob(job, models.JobCancelled)
+		return
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"url":       url,
 			"seller_id": sellerId,
-		}).Warningln("Error downloading xlsx file from given url")
+		}).Warningln("Error downloading file from given url")
 
-		uploadStatus.Ready = true
-		uploadStatus.Error = &models.Error{
+		w.failJob(job, &models.Error{
 			Code:    http.StatusBadRequest,
-			Message: "Couldn't download xlsx file on given link",
-		}
+			Message: "Couldn't download file on given link",
+		})
 		return
 	}
 
-	tmpFilePath := "./uploads/" + utils.RandStringRunes(40) + ".xlsx"
+	if job.Source.Format == "" {
+		job.Source.Format = models.DetectFormat(download.Header.Get("Content-Type"), download.Request.URL.Path)
+	}
+
+	tmpFilePath := "./uploads/" + utils.RandStringRunes(40) + "." + job.Source.Format
 	tmpFile, err := os.Create(tmpFilePath)
+	job.FilePath = tmpFilePath
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -81,17 +352,21 @@ func (w *worker) processDownload(url string, sellerId int, uploadStatus *UploadS
 
 		download.Body.Close()
 
-		uploadStatus.Ready = true
-		uploadStatus.Error = &models.Error{
+		w.failJob(job, &models.Error{
 			Code:    http.StatusInternalServerError,
 			Message: "Error creating temporary file",
-		}
+		})
 		return
 	}
 
 	_, err = io.Copy(tmpFile, download.Body)
 	download.Body.Close()
+	tmpFile.Close()
 
+	if err != nil && ctx.Err() != nil {
+		w.finishJob(job, models.JobCancelled)
+		return
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error":     err,
@@ -100,163 +375,709 @@ func (w *worker) processDownload(url string, sellerId int, uploadStatus *UploadS
 			"file_path": tmpFilePath,
 		}).Errorln("Error downloading to temporary file")
 
-		uploadStatus.Ready = true
-		uploadStatus.Error = &models.Error{
+		w.failJob(job, &models.Error{
 			Code:    http.StatusInternalServerError,
-			Message: "Error downloading xlsx file",
-		}
+			Message: "Error downloading file",
+		})
 		return
 	}
 
-	wb, err := xlsx.OpenFile(tmpFilePath)
+	w.processStoredFile(ctx, sellerId, job)
+}
+
+// processStoredFile processes file which is already saved to job.FilePath
+func (w *worker) processStoredFile(ctx context.Context, sellerId int, job *models.UploadJob) {
+	source, err := models.OpenRowSource(job.FilePath, job.Source)
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error":     err,
-			"url":       url,
+			"url":       job.Url,
 			"sellerId":  sellerId,
-			"file_path": tmpFilePath,
-		}).Errorln("Error opening xlsx file")
+			"file_path": job.FilePath,
+			"format":    job.Source.Format,
+		}).Errorln("Error opening uploaded file")
 
-		uploadStatus.Ready = true
-		uploadStatus.Error = &models.Error{
+		w.failJob(job, &models.Error{
 			Code:    http.StatusInternalServerError,
-			Message: "Error opening xlsx file(maybe file has wrong format)",
-		}
+			Message: "Error opening " + job.Source.Format + " file(maybe file has wrong format)",
+		})
 		return
 	}
+	defer source.Close()
 
-	w.processFile(wb, sellerId, uploadStatus)
+	w.processFile(ctx, source, sellerId, job)
 }
 
-func (w *worker) processFile(excelFile *xlsx.File, sellerId int, uploadStatus *UploadStatus) {
-	for _, sheet := range excelFile.Sheets {
-		var uploadQuery models.UploadQueryRow
-		sheet.ForEachRow(func(row *xlsx.Row) error {
-			newUploadQuery, err := models.FromExcelRow(row, sellerId)
-			if err != nil {
-				var cellValues []string
-				row.ForEachCell(func(c *xlsx.Cell) error {
-					cellValues = append(cellValues, c.Value)
-					return nil
-				})
-
-				log.WithFields(log.Fields{
-					"cells" : cellValues,
-				}).Warningln("Error parsing row")
-
-				uploadStatus.UploadResult.QueryErrors++
-				return nil
-			}
-			uploadQuery = *newUploadQuery
-			w.processQuery(uploadQuery, uploadStatus.UploadResult)
-			return nil
-		})
+func (w *worker) processFile(ctx context.Context, source models.RowSource, sellerId int, job *models.UploadJob) {
+	// dry run changes nothing, so there is nothing to roll back
+	atomic := job.Atomic && !job.DryRun
+	sales := w.sales
+	if sales != nil {
+		// changes of offers are audited as made by the job
+		sales = sales.WithJob(job.JobId)
+	}
+	if atomic {
+		tx, err := sales.Begin(ctx)
+		if err != nil && ctx.Err() != nil {
+			w.finishJob(job, models.JobCancelled)
+			return
+		}
+		if err != nil {
+			w.failJob(job, &models.Error{
+				Code:    http.StatusInternalServerError,
+				Message: "Error starting transaction",
+			})
+			return
+		}
+		sales = tx
+	}
+
+	progress := w.startProgress(job, source.TotalRows())
+
+	var diff *models.SaleDiff
+	if job.DryRun {
+		diff = sales.NewDiff()
+	}
+	applyBatch := func(batch []models.UploadQueryRow) error {
+		if diff != nil {
+			return w.diffBatch(ctx, diff, job, batch, progress)
+		}
+		return w.processBatch(ctx, sales, batch, progress)
+	}
+
+	var processErr error
+	// jobError is set when the file can't be processed further
+	var jobError *models.Error
+	var cancelled bool
+	var batch []models.UploadQueryRow
+	var rowErrors []models.RowError
+	// in replace mode offers of the file are collected to find missing ones,
+	// nothing is removed if offer_id of some row can't be read
+	replace := job.Mode == models.ModeReplace
+	seenOffers := make(map[int]struct{})
+	var unknownOffers bool
+
+	addRowError := func(rowError models.RowError) {
+		progress.addResult(models.UploadResult{QueryErrors: 1})
+		rowErrors = append(rowErrors, rowError)
+		if len(rowErrors) >= models.UpsertBatchSize {
+			w.saveRowErrors(job, rowErrors)
+			rowErrors = rowErrors[:0]
+		}
 	}
-	uploadStatus.Ready = true
-}
 
-func (w *worker) processQuery(q models.UploadQueryRow, u *models.UploadResult) {
-	if q.Available {
-		// offer is available, we need to insert/update sale data
-		sale, err := w.sales.FindByIdPair(q.Sale.SellerId, q.Sale.OfferId)
+	lastEvent := time.Now()
+	mapper := models.NewColumnMapper(job.Source.ColumnMapping)
+	for {
+		if ctx.Err() != nil {
+			cancelled = true
+			break
+		}
+		if now := time.Now(); now.Sub(lastEvent) >= eventInterval {
+			w.notify(job)
+			lastEvent = now
+		}
+
+		record, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil || isRowError(err) {
+			progress.addRow()
+		}
+		if rowError, ok := err.(*models.RowError); ok {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warningln("Error reading row")
+
+			addRowError(*rowError)
+			unknownOffers = true
+			continue
+		}
 		if err != nil {
-			// error happened while checking availability, count it as error during processing query
 			log.WithFields(log.Fields{
-				"error":     err,
-				"sale":      q.Sale,
-				"available": q.Available,
-			}).Errorln("Error processing finding by given seller_id and offer_id")
+				"error":  err,
+				"job_id": job.JobId,
+			}).Errorln("Error reading uploaded file")
 
-			u.InternalErrors++
-			return
+			jobError = &models.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Error reading uploaded file, it is probably corrupted",
+			}
+			break
 		}
-		if sale != nil {
-			// there is such sale in db, need to update it
-			rowsUpdated, err := w.sales.UpdateSale(q.Sale)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error":     err,
-					"sale":      q.Sale,
-					"available": q.Available,
-				}).Errorln("Error updating queries in db")
-
-				u.InternalErrors++
-				return
+
+		record, jobError = mapper.Map(record)
+		if jobError != nil {
+			log.WithFields(log.Fields{
+				"error":  jobError.Message,
+				"job_id": job.JobId,
+			}).Warningln("Error mapping columns of uploaded file")
+			break
+		}
+		if record == nil {
+			// header row
+			continue
+		}
+		if replace {
+			if offerId, err := models.RecordOfferId(record); err == nil {
+				seenOffers[offerId] = struct{}{}
+			} else {
+				unknownOffers = true
+			}
+		}
+
+		newUploadQuery, err := models.FromRecord(record, sellerId)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"cells": record.Values,
+				"error": err,
+			}).Warningln("Error parsing row")
+
+			addRowError(*err.(*models.RowError))
+			continue
+		}
+
+		batch = append(batch, *newUploadQuery)
+		if len(batch) < models.UpsertBatchSize {
+			continue
+		}
+		err = applyBatch(batch)
+		batch = batch[:0]
+		if err != nil && ctx.Err() != nil {
+			cancelled = true
+			break
+		}
+		if err != nil && atomic {
+			// stop at the first internal error, transaction is rolled back anyway
+			processErr = err
+			break
+		}
+	}
+
+	w.saveRowErrors(job, rowErrors)
+
+	if processErr == nil && jobError == nil && !cancelled && len(batch) > 0 {
+		err := applyBatch(batch)
+		if err != nil && ctx.Err() != nil {
+			cancelled = true
+		} else if atomic {
+			processErr = err
+		}
+	}
+
+	if replace && processErr == nil && jobError == nil && !cancelled {
+		if unknownOffers {
+			jobError = &models.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Offers missing from the file weren't removed, because offer_id of some rows is invalid",
 			}
-			u.UpdatedSales += rowsUpdated
 		} else {
-			// there is no such sale in db, creating new one
-			rowsCreated, err := w.sales.AddSale(q.Sale)
+			jobError, processErr = w.removeMissing(ctx, sales, diff, job, seenOffers, progress)
+		}
+		if processErr != nil && ctx.Err() != nil {
+			cancelled = true
+			processErr = nil
+		}
+	}
+
+	job.UploadResult = progress.currentResult()
+	if atomic {
+		if processErr == nil && jobError == nil && !cancelled {
+			processErr = sales.Commit()
+			if processErr != nil && ctx.Err() != nil {
+				cancelled = true
+				processErr = nil
+			}
+		} else {
+			sales.Rollback()
+		}
+
+		if processErr != nil || jobError != nil || cancelled {
+			job.UploadResult.CreatedSales = 0
+			job.UploadResult.UpdatedSales = 0
+			job.UploadResult.DeletedSales = 0
+			job.UploadResult.RemovedSales = 0
+			job.UploadResult.RolledBack = true
+		}
+	}
+
+	if cancelled {
+		w.finishJob(job, models.JobCancelled)
+		return
+	}
+
+	if jobError != nil {
+		w.failJob(job, jobError)
+		return
+	}
+
+	if processErr != nil {
+		message := "Error processing upload, all changes were rolled back"
+		if !atomic {
+			// without transaction only removal of missing offers stops the job
+			message = "Error removing offers missing from the file"
+		}
+		w.failJob(job, &models.Error{
+			Code:    http.StatusInternalServerError,
+			Message: message,
+		})
+		return
+	}
+	w.finishJob(job, models.JobDone)
+}
+
+// removeMissing removes offers of the seller which weren't seen in the file, or only saves them as changes in dry run.
+// Error is returned instead if more than MaxRemovePercent of the catalogue would be removed.
+func (w *worker) removeMissing(ctx context.Context, sales *models.Sales, diff *models.SaleDiff, job *models.UploadJob,
+	seenOffers map[int]struct{}, progress *jobProgress) (*models.Error, error) {
+	offerIds, err := sales.FindOfferIds(ctx, job.SellerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []int
+	for _, offerId := range offerIds {
+		if _, ok := seenOffers[offerId]; !ok {
+			missing = append(missing, offerId)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	catalogueSize := len(offerIds)
+	if diff != nil {
+		// dry run didn't change the catalogue, so it is counted as if the file was applied
+		result := progress.currentResult()
+		catalogueSize += int(result.CreatedSales - result.DeletedSales)
+	}
+	if len(missing)*100 > job.MaxRemovePercent*catalogueSize {
+		log.WithFields(log.Fields{
+			"job_id":         job.JobId,
+			"missing_count":  len(missing),
+			"catalogue_size": catalogueSize,
+		}).Warningln("Too many offers are missing from the file")
+
+		return &models.Error{
+			Code: http.StatusBadRequest,
+			Message: fmt.Sprintf("%d of %d offers are missing from the file, removing more than %d%% of the catalogue isn't allowed",
+				len(missing), catalogueSize, job.MaxRemovePercent),
+		}, nil
+	}
+
+	if diff != nil {
+		changes, result, err := diff.Remove(ctx, job.SellerId, missing)
+		progress.addResult(result)
+		if err != nil {
+			return nil, err
+		}
+		w.saveChanges(job, changes)
+		return nil, nil
+	}
+
+	removed, err := sales.DeleteOffers(ctx, job.SellerId, missing)
+	progress.addResult(models.UploadResult{RemovedSales: removed})
+	return nil, err
+}
+
+func isRowError(err error) bool {
+	_, ok := err.(*models.RowError)
+	return ok
+}
+
+func (w *worker) startProgress(job *models.UploadJob, totalRows int) *jobProgress {
+	startedAt := job.UpdatedAt
+	if job.StartedAt != nil {
+		startedAt = *job.StartedAt
+	}
+	progress := newJobProgress(startedAt, totalRows)
+
+	w.mutex.Lock()
+	w.progress[job.JobId] = progress
+	w.mutex.Unlock()
+
+	return progress
+}
+
+func (w *worker) saveRowErrors(job *models.UploadJob, rowErrors []models.RowError) {
+	err := w.jobs.AddRowErrors(job.JobId, rowErrors)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":        err,
+			"job_id":       job.JobId,
+			"errors_count": len(rowErrors),
+		}).Errorln("Error saving row errors")
+	}
+}
+
+// processBatch applies parsed rows to the database, rows which failed are counted in progress
+func (w *worker) processBatch(ctx context.Context, sales *models.Sales, batch []models.UploadQueryRow, progress *jobProgress) error {
+	result, err := sales.UpsertBatch(ctx, batch)
+	progress.addResult(result)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"rows_count": len(batch),
+		}).Errorln("Error applying batch of rows")
+	}
+	return err
+}
+
+// diffBatch finds changes which batch would make and saves them, rows which failed are counted in progress
+func (w *worker) diffBatch(ctx context.Context, diff *models.SaleDiff, job *models.UploadJob, batch []models.UploadQueryRow, progress *jobProgress) error {
+	changes, result, err := diff.Batch(ctx, batch)
+	progress.addResult(result)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"rows_count": len(batch),
+		}).Errorln("Error finding changes of batch of rows")
+		return err
+	}
+
+	w.saveChanges(job, changes)
+	return nil
+}
+
+func (w *worker) saveChanges(job *models.UploadJob, changes []models.SaleChange) {
+	err := w.jobs.AddChanges(job.JobId, changes)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"job_id":        job.JobId,
+			"changes_count": len(changes),
+		}).Errorln("Error saving changes of dry run")
+	}
+}
+
+// finishJob moves job to the given final state and saves it in job store
+func (w *worker) finishJob(job *models.UploadJob, state models.JobState) {
+	now := time.Now()
+	job.State = state
+	job.UpdatedAt = now
+	job.FinishedAt = &now
+
+	w.mutex.Lock()
+	delete(w.progress, job.JobId)
+	w.mutex.Unlock()
+
+	err := w.jobs.UpdateJob(*job)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"job_id": job.JobId,
+		}).Errorln("Error saving finished job")
+	}
+	w.notify(job)
+
+	if job.CallbackUrl != "" {
+		w.mutex.Lock()
+		status := w.jobStatus(job)
+		w.mutex.Unlock()
+
+		w.deliveries.Add(1)
+		go w.deliverWebhook(job.JobId, job.CallbackUrl, status)
+	}
+}
+
+func (w *worker) failJob(job *models.UploadJob, jobError *models.Error) {
+	job.Error = jobError
+	w.finishJob(job, models.JobFailed)
+}
+
+func (w *worker) StartJob(options JobOptions) (string, error) {
+	// ids are random, so ids of other jobs can't be guessed and don't repeat after restart
+	jobId, err := utils.NewUUID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	job := &models.UploadJob{
+		JobId:       jobId,
+		SellerId:    options.SellerId,
+		Url:         options.Url,
+		FilePath:    options.FilePath,
+		Source:      options.Source,
+		Atomic:      options.Atomic,
+		DryRun:      options.DryRun,
+		Mode:        options.Mode,
+		CallbackUrl: options.CallbackUrl,
+		State:       models.JobQueued,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+
+		IdempotencyKey:   options.IdempotencyKey,
+		MaxRemovePercent: w.config.MaxRemovePercent,
+	}
+	if job.Mode == "" {
+		job.Mode = models.ModeMerge
+	}
+	if options.MaxRemovePercent != nil {
+		job.MaxRemovePercent = *options.MaxRemovePercent
+	}
+
+	if options.IdempotencyKey != "" {
+		since := time.Time{}
+		if w.config.IdempotencyWindow > 0 {
+			since = now.Add(-w.config.IdempotencyWindow)
+		}
+		existingJob, err := w.jobs.FindByIdempotencyKey(options.SellerId, options.IdempotencyKey, since)
+		if err != nil {
+			return "", err
+		}
+		if existingJob != nil {
+			return existingJob.JobId, ErrJobExists
+		}
+		if w.config.IdempotencyWindow > 0 {
+			err := w.jobs.ReleaseIdempotencyKey(options.SellerId, options.IdempotencyKey, since)
 			if err != nil {
-				log.WithFields(log.Fields{
-					"error":     err,
-					"sale":      q.Sale,
-					"available": q.Available,
-				}).Errorln("Error adding new sale")
-
-				u.InternalErrors++
-				return
+				return "", err
 			}
-			u.CreatedSales += rowsCreated
 		}
-	} else {
-		// offer is unavailable, we need to delete it from db
-		rowsDeleted, err := w.sales.DeleteByIdPair(q.Sale.SellerId, q.Sale.OfferId)
+	}
+
+	// only StartJob puts jobs into the queue, so the reserved place can't be taken while the job is saved
+	w.mutex.Lock()
+	if w.closed || len(w.queue)+len(w.pending) >= cap(w.queue) {
+		w.mutex.Unlock()
+		return "", ErrQueueFull
+	}
+	w.pending[job.JobId] = struct{}{}
+	w.mutex.Unlock()
+
+	// the store keeps idempotency keys unique, so of concurrent requests with the same key
+	// only the first one starts a job, lookup and insert don't need the mutex
+	err = w.jobs.AddJob(*job)
+	if err != nil {
+		w.mutex.Lock()
+		delete(w.pending, job.JobId)
+		delete(w.cancelledQueued, job.JobId)
+		w.mutex.Unlock()
+	}
+	if err == models.ErrDuplicateIdempotencyKey {
+		existingJob, findErr := w.jobs.FindByIdempotencyKey(options.SellerId, options.IdempotencyKey, time.Time{})
+		if findErr != nil {
+			return "", findErr
+		}
+		if existingJob != nil {
+			return existingJob.JobId, ErrJobExists
+		}
+	}
+	if err != nil {
+		return "", err
+	}
 
+	w.mutex.Lock()
+	delete(w.pending, job.JobId)
+	_, cancelled := w.cancelledQueued[job.JobId]
+	delete(w.cancelledQueued, job.JobId)
+	closed := w.closed
+	if !closed && !cancelled {
+		w.enqueued++
+		w.queuePositions[job.JobId] = w.enqueued
+		w.queue <- job
+	}
+	w.mutex.Unlock()
+
+	if cancelled {
+		// job is already finished by CancelJob while it was being saved
+		return job.JobId, nil
+	}
+	if closed {
+		// the job will never be processed, so it must not be found later
+		w.jobs.DeleteById(job.JobId)
+		return "", ErrQueueFull
+	}
+	return job.JobId, nil
+}
+
+func (w *worker) GetJobStatus(jobId string) (UploadStatus, error) {
+	job, err := w.jobs.FindById(jobId)
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	// expired job is not found even before the janitor deletes it
+	if job == nil || w.expired(job, time.Now()) {
+		return UploadStatus{}, ErrJobNotFound
+	}
+
+	w.mutex.Lock()
+	status := w.jobStatus(job)
+	w.mutex.Unlock()
+
+	if job.CallbackUrl != "" {
+		status.Deliveries, err = w.jobs.FindDeliveries(jobId)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"error":     err,
-				"sale":      q.Sale,
-				"available": q.Available,
-				"seller_id": q.Sale.SellerId,
-				"offer_id":  q.Sale.OfferId,
-			}).Errorln("Error deleting existing pair")
-
-			u.InternalErrors++
-			return
+				"error":  err,
+				"job_id": jobId,
+			}).Errorln("Error getting webhook deliveries")
 		}
+	}
+	return status, nil
+}
+
+// expired reports whether the job finished more than JobRetention before now
+func (w *worker) expired(job *models.UploadJob, now time.Time) bool {
+	return w.config.JobRetention > 0 && job.FinishedAt != nil && job.FinishedAt.Before(now.Add(-w.config.JobRetention))
+}
 
-		u.DeletedSales += rowsDeleted
+// jobStatus makes status of the job, w.mutex must be held
+func (w *worker) jobStatus(job *models.UploadJob) UploadStatus {
+	status := UploadStatus{
+		JobId:  job.JobId,
+		Ready:  job.Finished(),
+		DryRun: job.DryRun,
+		State:  job.State,
+		Error:  job.Error,
 	}
+	if job.Finished() {
+		status.UploadResult = &job.UploadResult
+	}
+
+	if position, ok := w.queuePositions[job.JobId]; ok {
+		status.QueuePosition = position - w.dequeued
+	}
+	if progress, ok := w.progress[job.JobId]; ok {
+		// counters of a running job are only known by the worker
+		snapshot := progress.snapshot(time.Now())
+		result := progress.currentResult()
+		status.Progress = &snapshot
+		status.UploadResult = &result
+	}
+	return status
 }
 
-func (w *worker) StartJob(url string, sellerId int) string {
-	newJobId := w.generateJobId()
-	newUploadStatus := &UploadStatus{
-		Ready: false,
-		UploadResult: &models.UploadResult{
-			CreatedSales:   0,
-			UpdatedSales:   0,
-			DeletedSales:   0,
-			QueryErrors:    0,
-			InternalErrors: 0,
-		},
-		Error: nil,
+func (w *worker) Subscribe(jobId string) (<-chan UploadStatus, func()) {
+	updates := make(chan UploadStatus, 1)
+
+	w.mutex.Lock()
+	if w.subscribers[jobId] == nil {
+		w.subscribers[jobId] = make(map[chan UploadStatus]struct{})
+	}
+	w.subscribers[jobId][updates] = struct{}{}
+	w.mutex.Unlock()
+
+	unsubscribe := func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+
+		delete(w.subscribers[jobId], updates)
+		if len(w.subscribers[jobId]) == 0 {
+			delete(w.subscribers, jobId)
+		}
 	}
+	return updates, unsubscribe
+}
 
+// notify sends current status of the job to its subscribers, they are removed when the job is finished
+func (w *worker) notify(job *models.UploadJob) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
-	w.statuses[newJobId] = newUploadStatus
-	go w.processDownload(url, sellerId, newUploadStatus)
 
-	return newJobId
+	subscribers := w.subscribers[job.JobId]
+	if len(subscribers) == 0 {
+		return
+	}
+
+	status := w.jobStatus(job)
+	for updates := range subscribers {
+		sendStatus(updates, status)
+		if status.Ready {
+			close(updates)
+		}
+	}
+	if status.Ready {
+		delete(w.subscribers, job.JobId)
+	}
 }
 
-func (w *worker) GetJobStatus(jobId string) UploadStatus {
-	w.mutex.RLock()
-	defer w.mutex.RUnlock()
-	status, ok := w.statuses[jobId]
-	if !ok {
-		return UploadStatus{false, nil, nil}
+// notifyQueued sends new queue positions to subscribers of queued jobs, w.mutex must be held
+func (w *worker) notifyQueued() {
+	for jobId, subscribers := range w.subscribers {
+		position, ok := w.queuePositions[jobId]
+		if !ok {
+			continue
+		}
+
+		status := UploadStatus{
+			JobId:         jobId,
+			State:         models.JobQueued,
+			QueuePosition: position - w.dequeued,
+		}
+		for updates := range subscribers {
+			sendStatus(updates, status)
+		}
 	}
-	return *status
 }
 
-func (w *worker) FinishJob(jobId string) {
+// sendStatus replaces status which wasn't received yet, so it never blocks as long as
+// all senders hold w.mutex
+func sendStatus(updates chan UploadStatus, status UploadStatus) {
+	select {
+	case <-updates:
+	default:
+	}
+	updates <- status
+}
+
+func (w *worker) CancelJob(jobId string) error {
 	w.mutex.Lock()
-	defer w.mutex.Unlock()
-	if _, ok := w.statuses[jobId]; ok {
-		delete(w.statuses, jobId)
+	if cancel, ok := w.cancels[jobId]; ok {
+		w.mutex.Unlock()
+		// the job goroutine finishes the job when it notices cancellation
+		cancel()
+		return nil
+	}
+	_, queued := w.queuePositions[jobId]
+	_, pending := w.pending[jobId]
+	if queued || pending {
+		// run skips the job when it is taken from the queue, StartJob doesn't put a pending job there
+		w.cancelledQueued[jobId] = struct{}{}
+		delete(w.queuePositions, jobId)
+	}
+	w.mutex.Unlock()
+
+	job, err := w.jobs.FindById(jobId)
+	if err == nil && job == nil && pending {
+		// job isn't saved yet, so nobody could cancel it
+		w.mutex.Lock()
+		delete(w.cancelledQueued, jobId)
+		w.mutex.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return ErrJobNotFound
+	}
+	if job.Finished() {
+		return ErrJobFinished
+	}
+
+	// job is either queued or left unfinished by previous run of the service
+	w.finishJob(job, models.JobCancelled)
+	return nil
+}
+
+// Close stops accepting new jobs and waits until queued ones are processed and their webhooks are sent
+func (w *worker) Close() {
+	w.mutex.Lock()
+	alreadyClosed := w.closed
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+
+	w.wg.Wait()
+	if !alreadyClosed {
+		close(w.done)
 	}
+	w.deliveries.Wait()
 }
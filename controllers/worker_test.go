@@ -0,0 +1,389 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"github.com/tealeg/xlsx/v3"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWorker_QueueLimit(t *testing.T) {
+	// no pool workers, so queued jobs stay in the queue
+	w := NewWorker(nil, models.NewMemoryJobStore(), WorkerConfig{PoolSize: 0, QueueSize: 2})
+
+	firstJobId, err := w.StartJob(JobOptions{Url: "http://localhost/first.xlsx", SellerId: 1})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	secondJobId, err := w.StartJob(JobOptions{Url: "http://localhost/second.xlsx", SellerId: 1})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	if firstJobId == secondJobId || len(firstJobId) != 36 {
+		t.Errorf("Invalid job ids %q and %q", firstJobId, secondJobId)
+	}
+
+	_, err = w.StartJob(JobOptions{Url: "http://localhost/third.xlsx", SellerId: 1})
+	if err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+
+	for i, jobId := range []string{firstJobId, secondJobId} {
+		status, _ := w.GetJobStatus(jobId)
+		if status.Ready || status.State != models.JobQueued {
+			t.Errorf("Invalid status of queued job: %+v", status)
+		}
+		if status.QueuePosition != int64(i+1) {
+			t.Errorf("Invalid queue position, expected %d, got %d", i+1, status.QueuePosition)
+		}
+	}
+}
+
+func TestWorker_FailInterrupted(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	jobs.AddJob(models.UploadJob{JobId: "queued", SellerId: 1, State: models.JobQueued})
+	jobs.AddJob(models.UploadJob{JobId: "running", SellerId: 1, State: models.JobRunning})
+	jobs.AddJob(models.UploadJob{JobId: "done", SellerId: 1, State: models.JobDone})
+
+	// worker started after restart finds jobs left unfinished by the previous one
+	w := NewWorker(nil, jobs, WorkerConfig{QueueSize: 1})
+	defer w.Close()
+
+	for _, jobId := range []string{"queued", "running"} {
+		status, err := w.GetJobStatus(jobId)
+		if err != nil || !status.Ready || status.State != models.JobFailed || status.Error == nil {
+			t.Errorf("Interrupted job %s must fail, got %+v", jobId, status)
+		}
+		if job, _ := jobs.FindById(jobId); job == nil || job.FinishedAt == nil {
+			t.Errorf("Finish time of interrupted job %s must be set", jobId)
+		}
+	}
+	if status, _ := w.GetJobStatus("done"); status.State != models.JobDone {
+		t.Errorf("Finished job must be kept, got %+v", status)
+	}
+}
+
+func TestWorker_IdempotencyKey(t *testing.T) {
+	w := NewWorker(nil, models.NewMemoryJobStore(), WorkerConfig{PoolSize: 0, QueueSize: 3, IdempotencyWindow: time.Hour})
+
+	options := JobOptions{Url: "http://localhost/first.xlsx", SellerId: 1, IdempotencyKey: "key"}
+	jobId, err := w.StartJob(options)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	repeatedJobId, err := w.StartJob(options)
+	if err != ErrJobExists || repeatedJobId != jobId {
+		t.Errorf("Expected ErrJobExists with job %s, got %v with job %s", jobId, err, repeatedJobId)
+	}
+
+	// keys of different sellers don't interfere
+	options.SellerId = 2
+	otherJobId, err := w.StartJob(options)
+	if err != nil || otherJobId == jobId {
+		t.Errorf("Expected a new job of another seller, got %v with job %s", err, otherJobId)
+	}
+}
+
+func TestWorker_IdempotencyKeyExpired(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	w := NewWorker(nil, jobs, WorkerConfig{PoolSize: 0, QueueSize: 1, IdempotencyWindow: time.Hour})
+
+	createdAt := time.Now().Add(-2 * time.Hour)
+	jobs.AddJob(models.UploadJob{JobId: "expired", SellerId: 1, IdempotencyKey: "key", State: models.JobDone, CreatedAt: createdAt})
+
+	jobId, err := w.StartJob(JobOptions{Url: "http://localhost/first.xlsx", SellerId: 1, IdempotencyKey: "key"})
+	if err != nil || jobId == "expired" {
+		t.Errorf("Expected a new job, got %v with job %s", err, jobId)
+	}
+	if job, _ := jobs.FindById("expired"); job.IdempotencyKey != "" {
+		t.Errorf("Key of expired job must be released")
+	}
+}
+
+// racingJobStore misses jobs by idempotency key once, like when a concurrent request
+// adds a job with the same key between lookup and insert
+type racingJobStore struct {
+	*models.MemoryJobStore
+	missed bool
+}
+
+func (s *racingJobStore) FindByIdempotencyKey(sellerId int, key string, since time.Time) (*models.UploadJob, error) {
+	if !s.missed {
+		s.missed = true
+		return nil, nil
+	}
+	return s.MemoryJobStore.FindByIdempotencyKey(sellerId, key, since)
+}
+
+func TestWorker_IdempotencyKeyRace(t *testing.T) {
+	jobs := &racingJobStore{MemoryJobStore: models.NewMemoryJobStore()}
+	w := NewWorker(nil, jobs, WorkerConfig{PoolSize: 0, QueueSize: 1}).(*worker)
+
+	jobs.AddJob(models.UploadJob{JobId: "first", SellerId: 1, IdempotencyKey: "key", State: models.JobQueued, CreatedAt: time.Now()})
+
+	jobId, err := w.StartJob(JobOptions{Url: "http://localhost/first.xlsx", SellerId: 1, IdempotencyKey: "key"})
+	if err != ErrJobExists || jobId != "first" {
+		t.Errorf("Expected ErrJobExists with job first, got %v with job %s", err, jobId)
+	}
+	if len(w.pending) != 0 || len(w.queue) != 0 {
+		t.Errorf("Place in the queue must be freed, pending %d, queued %d", len(w.pending), len(w.queue))
+	}
+}
+
+// cancellingJobStore cancels every job right after it is saved, before StartJob puts it into the queue
+type cancellingJobStore struct {
+	*models.MemoryJobStore
+	worker Worker
+}
+
+func (s *cancellingJobStore) AddJob(job models.UploadJob) error {
+	err := s.MemoryJobStore.AddJob(job)
+	if err != nil {
+		return err
+	}
+	return s.worker.CancelJob(job.JobId)
+}
+
+func TestWorker_CancelPendingJob(t *testing.T) {
+	jobs := &cancellingJobStore{MemoryJobStore: models.NewMemoryJobStore()}
+	w := NewWorker(nil, jobs, WorkerConfig{PoolSize: 0, QueueSize: 1}).(*worker)
+	jobs.worker = w
+
+	jobId, err := w.StartJob(JobOptions{Url: "http://localhost/first.xlsx", SellerId: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	status, _ := w.GetJobStatus(jobId)
+	if status.State != models.JobCancelled {
+		t.Errorf("Invalid status of job cancelled while saved: %+v", status)
+	}
+	if len(w.queue) != 0 || len(w.pending) != 0 || len(w.cancelledQueued) != 0 {
+		t.Errorf("Cancelled job must not be queued, queued %d, pending %d", len(w.queue), len(w.pending))
+	}
+}
+
+func TestWorker_Subscribe(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	w := NewWorker(nil, jobs, WorkerConfig{PoolSize: 0, QueueSize: 1}).(*worker)
+
+	jobId, err := w.StartJob(JobOptions{Url: "http://localhost/first.xlsx", SellerId: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	updates, unsubscribe := w.Subscribe(jobId)
+	defer unsubscribe()
+
+	job, _ := jobs.FindById(jobId)
+	w.failJob(job, &models.Error{Code: 400, Message: "test error"})
+
+	status, ok := <-updates
+	if !ok || !status.Ready || status.State != models.JobFailed || status.Error == nil {
+		t.Errorf("Invalid final status: %+v", status)
+	}
+	if _, ok := <-updates; ok {
+		t.Errorf("Updates must be closed after the final status")
+	}
+}
+
+func TestWorker_CancelJob(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	w := NewWorker(nil, jobs, WorkerConfig{PoolSize: 0, QueueSize: 2}).(*worker)
+
+	queuedJobId, _ := w.StartJob(JobOptions{Url: "http://localhost/first.xlsx", SellerId: 1})
+	if err := w.CancelJob(queuedJobId); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	status, _ := w.GetJobStatus(queuedJobId)
+	if !status.Ready || status.State != models.JobCancelled || status.QueuePosition != 0 {
+		t.Errorf("Invalid status of cancelled job: %+v", status)
+	}
+
+	if err := w.CancelJob(queuedJobId); err != ErrJobFinished {
+		t.Errorf("Expected ErrJobFinished, got %v", err)
+	}
+	if err := w.CancelJob("unknown"); err != ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+
+	// running job stops before the next row
+	runningJobId, _ := w.StartJob(JobOptions{Url: "http://localhost/second.xlsx", SellerId: 1})
+	job, _ := jobs.FindById(runningJobId)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	wb := xlsx.NewFile()
+	sheet, _ := wb.AddSheet("offers")
+	sheet.AddRow().AddCell().SetValue("1")
+	w.processFile(ctx, models.NewExcelSource(wb), 1, job)
+
+	status, _ = w.GetJobStatus(runningJobId)
+	if status.State != models.JobCancelled || status.UploadResult == nil || status.UploadResult.QueryErrors != 0 {
+		t.Errorf("Invalid status of cancelled job: %+v", status)
+	}
+}
+
+func TestWorker_PruneJobs(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	w := NewWorker(nil, jobs, WorkerConfig{QueueSize: 1, JobRetention: time.Hour}).(*worker)
+	defer w.Close()
+
+	filePath := filepath.Join(t.TempDir(), "upload")
+	ioutil.WriteFile(filePath, []byte("1,offer,100,1,true"), 0644)
+
+	finishedAt := time.Now().Add(-2 * time.Hour)
+	jobs.AddJob(models.UploadJob{JobId: "expired", FilePath: filePath, State: models.JobDone, FinishedAt: &finishedAt})
+	jobs.AddJob(models.UploadJob{JobId: "queued", State: models.JobQueued})
+
+	w.pruneJobs(time.Now())
+
+	if job, _ := jobs.FindById("expired"); job != nil {
+		t.Errorf("Expired job must be deleted")
+	}
+	if job, _ := jobs.FindById("queued"); job == nil {
+		t.Errorf("Unfinished job must be kept")
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("File of expired job must be removed")
+	}
+}
+
+func TestWorker_GetJobStatusExpired(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+	w := NewWorker(nil, jobs, WorkerConfig{QueueSize: 1, JobRetention: time.Hour})
+	defer w.Close()
+
+	expiredAt := time.Now().Add(-2 * time.Hour)
+	finishedAt := time.Now()
+	jobs.AddJob(models.UploadJob{JobId: "expired", State: models.JobDone, FinishedAt: &expiredAt})
+	jobs.AddJob(models.UploadJob{JobId: "done", State: models.JobDone, FinishedAt: &finishedAt})
+
+	// the janitor hasn't deleted the expired job yet
+	if _, err := w.GetJobStatus("expired"); err != ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound for expired job, got %v", err)
+	}
+	if status, err := w.GetJobStatus("done"); err != nil || !status.Ready {
+		t.Errorf("Invalid status of finished job: %+v %v", status, err)
+	}
+}
+
+func TestWorker_AtomicMode(t *testing.T) {
+	cases := []struct {
+		name       string
+		failBatch  bool
+		state      models.JobState
+		created    int64
+		rolledBack bool
+	}{
+		{"committed", false, models.JobDone, models.UpsertBatchSize + 1, false},
+		// the first batch is already applied when the second one fails
+		{"internal error", true, models.JobFailed, 0, true},
+	}
+
+	for _, c := range cases {
+		db, mock, _ := sqlmock.New()
+		jobs := models.NewMemoryJobStore()
+		w := NewWorker(&models.Sales{DB: db}, jobs, WorkerConfig{QueueSize: 1}).(*worker)
+
+		jobId, _ := w.StartJob(JobOptions{Url: "http://localhost/offers.xlsx", SellerId: 1, Atomic: true})
+		job, _ := jobs.FindById(jobId)
+
+		firstBatch := sqlmock.NewRows([]string{"inserted"})
+		for i := 0; i < models.UpsertBatchSize; i++ {
+			firstBatch.AddRow(true)
+		}
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO sales`).WillReturnRows(firstBatch)
+		if c.failBatch {
+			mock.ExpectQuery(`INSERT INTO sales`).WillReturnError(sql.ErrConnDone)
+			mock.ExpectRollback()
+		} else {
+			mock.ExpectQuery(`INSERT INTO sales`).WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+			mock.ExpectCommit()
+		}
+
+		wb := xlsx.NewFile()
+		sheet, _ := wb.AddSheet("offers")
+		for offerId := 1; offerId <= models.UpsertBatchSize+1; offerId++ {
+			row := sheet.AddRow()
+			for _, value := range []string{strconv.Itoa(offerId), "offer", "100", "1", "true"} {
+				row.AddCell().SetValue(value)
+			}
+		}
+		w.processFile(context.Background(), models.NewExcelSource(wb), 1, job)
+
+		status, _ := w.GetJobStatus(jobId)
+		result := status.UploadResult
+		if status.State != c.state || result.CreatedSales != c.created || result.RolledBack != c.rolledBack {
+			t.Errorf("%s: invalid status %+v, result %+v", c.name, status, result)
+		}
+		if c.failBatch && (status.Error == nil || status.Error.Code != http.StatusInternalServerError) {
+			t.Errorf("%s: invalid error %+v", c.name, status.Error)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: unmet expectations: %s", c.name, err.Error())
+		}
+		db.Close()
+	}
+}
+
+func TestWorker_ReplaceMode(t *testing.T) {
+	cases := []struct {
+		name             string
+		maxRemovePercent int
+		state            models.JobState
+		removed          int64
+	}{
+		// offers 3 and 4 are missing, which is a half of the catalogue
+		{"allowed", 50, models.JobDone, 2},
+		{"too many missing", 20, models.JobFailed, 0},
+	}
+
+	for _, c := range cases {
+		db, mock, _ := sqlmock.New()
+		jobs := models.NewMemoryJobStore()
+		w := NewWorker(&models.Sales{DB: db}, jobs, WorkerConfig{QueueSize: 1, MaxRemovePercent: c.maxRemovePercent}).(*worker)
+
+		jobId, _ := w.StartJob(JobOptions{Url: "http://localhost/offers.xlsx", SellerId: 1, Mode: models.ModeReplace})
+		job, _ := jobs.FindById(jobId)
+
+		mock.ExpectQuery(`INSERT INTO sales`).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(false).AddRow(false))
+		mock.ExpectQuery(`SELECT offer_id FROM sales WHERE seller_id \= \$1`).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"offer_id"}).AddRow(1).AddRow(2).AddRow(3).AddRow(4))
+		if c.removed > 0 {
+			mock.ExpectExec(`UPDATE sales SET (.+) WHERE available AND \(seller_id, offer_id\) IN \(\(\$2, \$3\), \(\$4, \$5\)\);`).
+				WithArgs(jobId, 1, 3, 1, 4).WillReturnResult(sqlmock.NewResult(0, 2))
+		}
+
+		wb := xlsx.NewFile()
+		sheet, _ := wb.AddSheet("offers")
+		for _, offerId := range []string{"1", "2"} {
+			row := sheet.AddRow()
+			for _, value := range []string{offerId, "offer", "100", "1", "true"} {
+				row.AddCell().SetValue(value)
+			}
+		}
+		w.processFile(context.Background(), models.NewExcelSource(wb), 1, job)
+
+		status, _ := w.GetJobStatus(jobId)
+		if status.State != c.state || status.UploadResult.RemovedSales != c.removed {
+			t.Errorf("%s: invalid status %+v, result %+v", c.name, status, status.UploadResult)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: unmet expectations: %s", c.name, err.Error())
+		}
+		db.Close()
+	}
+}
@@ -1,13 +1,186 @@
-DROP TABLE IF EXISTS sales;
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+DROP TABLE IF EXISTS sales CASCADE;
 CREATE TABLE IF NOT EXISTS sales (
     sale_id SERIAL PRIMARY KEY,
     offer_id int,
     seller_id int,
     price int,
     name varchar(200),
-    quantity int
+    quantity int,
+    available boolean DEFAULT true,
+    updated_at timestamp DEFAULT now(),
+    deleted_at timestamp NULL,
+    -- job which changed the offer last, NULL if it was changed without a job
+    job_id varchar(64) NULL,
+    name_tsv tsvector GENERATED ALWAYS AS (
+        to_tsvector('russian', coalesce(name, '')) || to_tsvector('english', coalesce(name, ''))
+    ) STORED,
+    CONSTRAINT sale_pair_unique UNIQUE (seller_id, offer_id)
+);
+
+CREATE INDEX sale_offer_order_index ON sales(offer_id, seller_id);
+CREATE INDEX sale_price_order_index ON sales(price, seller_id, offer_id);
+CREATE INDEX sale_quantity_order_index ON sales(quantity, seller_id, offer_id);
+CREATE INDEX sale_name_order_index ON sales(name, seller_id, offer_id);
+-- used by purge of offers deleted long ago
+CREATE INDEX sale_deleted_index ON sales(deleted_at) WHERE NOT available;
+CREATE INDEX sale_name_tsv_index ON sales USING GIN (name_tsv);
+-- used both by substring search with LIKE and by trigram similarity
+CREATE INDEX sale_name_trgm_index ON sales USING GIN (LOWER(name) gin_trgm_ops);
+
+-- sales_audit keeps every change of offers, it isn't cleaned when offers are purged
+DROP TABLE IF EXISTS sales_audit;
+CREATE TABLE IF NOT EXISTS sales_audit (
+    audit_id BIGSERIAL PRIMARY KEY,
+    seller_id int,
+    offer_id int,
+    action varchar(16),
+    job_id varchar(64) NULL,
+    changed_at timestamp DEFAULT now(),
+    old_sale text DEFAULT 'null',
+    new_sale text DEFAULT 'null'
+);
+
+CREATE INDEX sales_audit_offer_index ON sales_audit(seller_id, offer_id, audit_id);
+
+CREATE OR REPLACE FUNCTION sale_json(sale sales) RETURNS text AS $$
+    SELECT json_build_object(
+        'offer_id', sale.offer_id, 'seller_id', sale.seller_id, 'name', sale.name,
+        'price', sale.price, 'quantity', sale.quantity, 'available', sale.available
+    )::text;
+$$ LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION audit_sale() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO sales_audit (seller_id, offer_id, action, job_id, new_sale)
+        VALUES (NEW.seller_id, NEW.offer_id, 'create', NEW.job_id, sale_json(NEW));
+        RETURN NULL;
+    END IF;
+
+    -- upsert rewrites offers which didn't change, such updates aren't audited
+    IF (OLD.name, OLD.price, OLD.quantity, OLD.available) IS NOT DISTINCT FROM (NEW.name, NEW.price, NEW.quantity, NEW.available) THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO sales_audit (seller_id, offer_id, action, job_id, old_sale, new_sale)
+    VALUES (NEW.seller_id, NEW.offer_id,
+        CASE WHEN OLD.available AND NOT NEW.available THEN 'delete' ELSE 'update' END,
+        NEW.job_id, sale_json(OLD), sale_json(NEW));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER sales_audit_trigger AFTER INSERT OR UPDATE ON sales
+    FOR EACH ROW EXECUTE FUNCTION audit_sale();
+
+-- sale_prices is a time series of prices of every offer starting from the price it was created with
+DROP TABLE IF EXISTS sale_prices;
+CREATE TABLE IF NOT EXISTS sale_prices (
+    price_id BIGSERIAL PRIMARY KEY,
+    seller_id int,
+    offer_id int,
+    job_id varchar(64) NULL,
+    -- NULL for the price offer was created with
+    old_price int NULL,
+    price int,
+    changed_at timestamp DEFAULT now()
+);
+
+CREATE INDEX sale_prices_offer_index ON sale_prices(seller_id, offer_id, price_id);
+CREATE INDEX sale_prices_job_index ON sale_prices(seller_id, job_id);
+
+CREATE OR REPLACE FUNCTION record_sale_price() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO sale_prices (seller_id, offer_id, job_id, price)
+        VALUES (NEW.seller_id, NEW.offer_id, NEW.job_id, NEW.price);
+    ELSIF OLD.price IS DISTINCT FROM NEW.price THEN
+        INSERT INTO sale_prices (seller_id, offer_id, job_id, old_price, price)
+        VALUES (NEW.seller_id, NEW.offer_id, NEW.job_id, OLD.price, NEW.price);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER sale_prices_trigger AFTER INSERT OR UPDATE OF price ON sales
+    FOR EACH ROW EXECUTE FUNCTION record_sale_price();
+
+DROP TABLE IF EXISTS upload_jobs CASCADE;
+CREATE TABLE IF NOT EXISTS upload_jobs (
+    job_id varchar(64) PRIMARY KEY,
+    seller_id int,
+    url text,
+    file_path text DEFAULT '',
+    format varchar(16) DEFAULT '',
+    delimiter varchar(4) DEFAULT '',
+    encoding varchar(32) DEFAULT '',
+    column_mapping text DEFAULT 'null',
+    atomic boolean DEFAULT false,
+    dry_run boolean DEFAULT false,
+    mode varchar(16) DEFAULT 'merge',
+    max_remove_percent int DEFAULT 0,
+    callback_url text DEFAULT '',
+    idempotency_key varchar(255) DEFAULT '',
+    state varchar(16),
+    created_at timestamp,
+    started_at timestamp NULL,
+    updated_at timestamp,
+    finished_at timestamp NULL,
+    created_sales bigint DEFAULT 0,
+    updated_sales bigint DEFAULT 0,
+    deleted_sales bigint DEFAULT 0,
+    removed_sales bigint DEFAULT 0,
+    query_errors bigint DEFAULT 0,
+    internal_errors bigint DEFAULT 0,
+    rolled_back boolean DEFAULT false,
+    error_code int NULL,
+    error_message text NULL
+);
+
+CREATE INDEX upload_jobs_seller_index ON upload_jobs(seller_id, created_at);
+CREATE INDEX upload_jobs_finished_index ON upload_jobs(finished_at);
+-- keeps idempotency keys of every seller distinct, keys of expired jobs are released by the service
+CREATE UNIQUE INDEX upload_jobs_idempotency_index ON upload_jobs(seller_id, idempotency_key) WHERE idempotency_key <> '';
+
+DROP TABLE IF EXISTS upload_job_errors;
+CREATE TABLE IF NOT EXISTS upload_job_errors (
+    error_id BIGSERIAL PRIMARY KEY,
+    job_id varchar(64) REFERENCES upload_jobs(job_id) ON DELETE CASCADE,
+    sheet text,
+    row_number int,
+    column_name varchar(64),
+    value text,
+    reason text
+);
+
+CREATE INDEX upload_job_errors_job_index ON upload_job_errors(job_id);
+
+DROP TABLE IF EXISTS upload_job_deliveries;
+CREATE TABLE IF NOT EXISTS upload_job_deliveries (
+    delivery_id BIGSERIAL PRIMARY KEY,
+    job_id varchar(64) REFERENCES upload_jobs(job_id) ON DELETE CASCADE,
+    attempt int,
+    sent_at timestamp,
+    status_code int NULL,
+    error text NULL
+);
+
+CREATE INDEX upload_job_deliveries_job_index ON upload_job_deliveries(job_id);
+
+DROP TABLE IF EXISTS upload_job_changes;
+CREATE TABLE IF NOT EXISTS upload_job_changes (
+    change_id BIGSERIAL PRIMARY KEY,
+    job_id varchar(64) REFERENCES upload_jobs(job_id) ON DELETE CASCADE,
+    action varchar(16),
+    offer_id int,
+    old_sale text DEFAULT 'null',
+    new_sale text DEFAULT 'null',
+    -- comma separated names of changed fields
+    fields text DEFAULT ''
 );
 
-CREATE INDEX sale_pair_index ON sales(offer_id, seller_id);
+CREATE INDEX upload_job_changes_job_index ON upload_job_changes(job_id, action);
 
-INSERT INTO sales (offer_id, seller_id, price, name, quantity) VALUES (1, 1, 100, 'Test sale', 1);
\ No newline at end of file
+INSERT INTO sales (offer_id, seller_id, price, name, quantity) VALUES (1, 1, 100, 'Test sale', 1);
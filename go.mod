@@ -6,8 +6,9 @@ require github.com/lib/pq v1.9.0
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0
-	github.com/gorilla/handlers v1.5.1 // indirect
+	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/tealeg/xlsx/v3 v3.2.0
+	golang.org/x/text v0.3.2
 )
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/fertilewaif/avito-mx-backend-test/controllers"
+	"github.com/fertilewaif/avito-mx-backend-test/utils"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
@@ -16,6 +17,18 @@ import (
 
 const (
 	PORT = 5432
+
+	DefaultWorkerPoolSize    = 4
+	DefaultWorkerQueueSize   = 100
+	DefaultWebhookAttempts   = 5
+	WebhookBackoff           = time.Second
+	DefaultJobRetentionHours = 7 * 24
+	DefaultIdempotencyHours  = 24
+	DefaultMaxRemovePercent  = 20
+	DefaultDeletedSalesDays  = 90
+
+	UploadsDir           = "./uploads/"
+	DefaultUploadMaxSize = 100 * 1024 * 1024
 )
 
 func initDB(username, password, database, host string) (*sql.DB, error) {
@@ -57,20 +70,63 @@ func main() {
 
 	if err != nil {
 		log.WithFields(log.Fields{
-			"error": err,
-			"postgres_user": dbUser,
+			"error":             err,
+			"postgres_user":     dbUser,
 			"postgres_password": dbPassword,
-			"postgres_db_name": dbName,
-			"postgres_db_host": dbHost,
+			"postgres_db_name":  dbName,
+			"postgres_db_host":  dbHost,
 		}).Fatalln("Can't connect to database")
 	}
 
+	workerConfig := controllers.WorkerConfig{
+		PoolSize:  utils.GetEnvInt("WORKER_POOL_SIZE", DefaultWorkerPoolSize),
+		QueueSize: utils.GetEnvInt("WORKER_QUEUE_SIZE", DefaultWorkerQueueSize),
+
+		WebhookSecret:   os.Getenv("WEBHOOK_SECRET"),
+		WebhookAttempts: utils.GetEnvInt("WEBHOOK_ATTEMPTS", DefaultWebhookAttempts),
+		WebhookBackoff:  WebhookBackoff,
+		JobRetention:    time.Duration(utils.GetEnvInt("JOB_RETENTION_HOURS", DefaultJobRetentionHours)) * time.Hour,
+
+		IdempotencyWindow: time.Duration(utils.GetEnvInt("IDEMPOTENCY_WINDOW_HOURS", DefaultIdempotencyHours)) * time.Hour,
+		MaxRemovePercent:  utils.GetEnvInt("MAX_REMOVE_PERCENT", DefaultMaxRemovePercent),
+
+		DeletedSalesRetention: time.Duration(utils.GetEnvInt("DELETED_SALES_RETENTION_DAYS", DefaultDeletedSalesDays)) * 24 * time.Hour,
+	}
+	// jobs would never be processed without workers, and every job is rejected without a queue
+	if workerConfig.PoolSize <= 0 || workerConfig.QueueSize <= 0 {
+		log.WithFields(log.Fields{
+			"worker_pool_size":  workerConfig.PoolSize,
+			"worker_queue_size": workerConfig.QueueSize,
+		}).Fatalln("WORKER_POOL_SIZE and WORKER_QUEUE_SIZE must be positive")
+	}
+
+	uploadConfig := controllers.UploadConfig{
+		Dir:     UploadsDir,
+		MaxSize: int64(utils.GetEnvInt("UPLOAD_MAX_SIZE", DefaultUploadMaxSize)),
+	}
+
+	authConfig := controllers.AuthConfig{
+		SellerTokenSecret: os.Getenv("SELLER_TOKEN_SECRET"),
+	}
+	if authConfig.SellerTokenSecret == "" {
+		log.Warningln("SELLER_TOKEN_SECRET is empty, every job request will be rejected")
+	}
+
 	r := mux.NewRouter()
-	handler := controllers.NewSalesController(db)
+	handler := controllers.NewSalesController(db, workerConfig, uploadConfig, authConfig)
 
 	r.HandleFunc("/offers", handler.GetSales).Methods("GET")
+	r.HandleFunc("/offers/{seller_id}/{offer_id}/history", handler.GetSaleHistory).Methods("GET")
+	r.HandleFunc("/offers/{seller_id}/{offer_id}/prices", handler.GetPriceHistory).Methods("GET")
+	r.HandleFunc("/offers/{seller_id}/price_stats", handler.GetPriceStats).Methods("GET")
 	r.HandleFunc("/upload", handler.Upload).Methods("POST")
 	r.HandleFunc("/get_status", handler.GetJobStatus).Methods("GET")
+	r.HandleFunc("/jobs/{id}/errors", handler.GetJobErrors).Methods("GET")
+	r.HandleFunc("/jobs/{id}/changes", handler.GetJobChanges).Methods("GET")
+	r.HandleFunc("/jobs/{id}/events", handler.GetJobEvents).Methods("GET")
+	r.HandleFunc("/jobs", handler.ListJobs).Methods("GET")
+	r.HandleFunc("/jobs/{id}", handler.CancelJob).Methods("DELETE")
+	r.HandleFunc("/jobs/{id}/cancel", handler.CancelJob).Methods("POST")
 
 	loggingRouter := handlers.LoggingHandler(os.Stdout, r)
 
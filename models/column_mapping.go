@@ -0,0 +1,193 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	ColumnOfferId   = "offer_id"
+	ColumnName      = "name"
+	ColumnPrice     = "price"
+	ColumnQuantity  = "quantity"
+	ColumnAvailable = "available"
+)
+
+// uploadColumns is the order of values expected by FromRecord
+var uploadColumns = []string{ColumnOfferId, ColumnName, ColumnPrice, ColumnQuantity, ColumnAvailable}
+
+// ColumnAliases are header names recognized for every column, they are compared case insensitively
+var ColumnAliases = map[string][]string{
+	ColumnOfferId:   {"offer_id", "offer id", "offerid", "id", "id товара", "артикул", "код товара"},
+	ColumnName:      {"name", "title", "название", "наименование", "название товара", "товар"},
+	ColumnPrice:     {"price", "цена", "стоимость"},
+	ColumnQuantity:  {"quantity", "qty", "количество", "кол-во", "остаток"},
+	ColumnAvailable: {"available", "availability", "в наличии", "наличие", "доступен"},
+}
+
+// availableByDefault is used as value of available column when header has no such column
+const availableByDefault = "true"
+
+// ValidateColumnMapping checks that custom mapping refers only to known columns
+func ValidateColumnMapping(mapping map[string]string) *Error {
+	for column, header := range mapping {
+		if _, ok := ColumnAliases[column]; !ok {
+			return &Error{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("Unknown column %q in column_mapping, must be one of %s", column, strings.Join(uploadColumns, ", ")),
+			}
+		}
+		if strings.TrimSpace(header) == "" {
+			return &Error{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("Empty header name for column %q in column_mapping", column),
+			}
+		}
+	}
+	return nil
+}
+
+// ColumnMapper detects header row in every sheet and reorders values of the following records
+// to the order expected by FromRecord. Sheets without header use positional columns.
+type ColumnMapper struct {
+	// headers maps normalized header name to column
+	headers   map[string]string
+	hasCustom bool
+
+	sheet   string
+	started bool
+	// indices keeps position of every upload column in source records, -1 if there is no such column
+	indices []int
+	// recordHeader is the last header of records which carry it, for which indices were resolved
+	recordHeader string
+}
+
+// NewColumnMapper creates mapper which recognizes ColumnAliases and custom header names,
+// custom mapping takes precedence over aliases
+func NewColumnMapper(custom map[string]string) *ColumnMapper {
+	headers := make(map[string]string)
+	for column, aliases := range ColumnAliases {
+		if _, ok := custom[column]; ok {
+			continue
+		}
+		for _, alias := range aliases {
+			headers[normalizeHeader(alias)] = column
+		}
+	}
+	for column, header := range custom {
+		headers[normalizeHeader(header)] = column
+	}
+
+	return &ColumnMapper{
+		headers:   headers,
+		hasCustom: len(custom) > 0,
+	}
+}
+
+func normalizeHeader(header string) string {
+	return strings.Join(strings.Fields(strings.ToLower(header)), " ")
+}
+
+// Map returns record with values in FromRecord order, or nil if record is a header row.
+// Error is returned when header lacks required columns.
+func (m *ColumnMapper) Map(record *Record) (*Record, *Error) {
+	if record.Header != nil {
+		// records with own header (e.g. JSON Lines objects) are never header rows themselves
+		headerKey := strings.Join(record.Header, "\x00")
+		if m.indices == nil || m.recordHeader != headerKey {
+			indices, _ := m.resolve(record.Header)
+			if missing := missingColumns(indices); len(missing) > 0 {
+				return nil, &Error{
+					Code:    http.StatusBadRequest,
+					Message: fmt.Sprintf("Header of row %d has no required columns: %s", record.Row, strings.Join(missing, ", ")),
+				}
+			}
+			m.indices = indices
+			m.recordHeader = headerKey
+		}
+		return m.reorder(record), nil
+	}
+
+	if !m.started || m.sheet != record.Sheet {
+		m.started = true
+		m.sheet = record.Sheet
+		m.indices = nil
+
+		indices, matched := m.resolve(record.Values)
+		// a single match may be a product name equal to some alias, so at least two are required
+		if matched >= 2 {
+			if missing := missingColumns(indices); len(missing) > 0 {
+				return nil, &Error{
+					Code:    http.StatusBadRequest,
+					Message: fmt.Sprintf("Header of sheet %q has no required columns: %s", record.Sheet, strings.Join(missing, ", ")),
+				}
+			}
+
+			m.indices = indices
+			return nil, nil
+		}
+
+		if m.hasCustom {
+			return nil, &Error{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("Header row wasn't found in sheet %q, but column_mapping is set", record.Sheet),
+			}
+		}
+	}
+
+	if m.indices == nil {
+		return record, nil
+	}
+	return m.reorder(record), nil
+}
+
+// missingColumns returns required upload columns which weren't found in header
+func missingColumns(indices []int) []string {
+	var missing []string
+	for i, column := range uploadColumns {
+		if indices[i] < 0 && column != ColumnAvailable {
+			missing = append(missing, column)
+		}
+	}
+	return missing
+}
+
+// resolve finds positions of upload columns in header and amount of recognized header cells
+func (m *ColumnMapper) resolve(header []string) ([]int, int) {
+	indices := make([]int, len(uploadColumns))
+	for i := range indices {
+		indices[i] = -1
+	}
+
+	matched := 0
+	for position, name := range header {
+		column, ok := m.headers[normalizeHeader(name)]
+		if !ok {
+			continue
+		}
+		for i, uploadColumn := range uploadColumns {
+			if uploadColumn == column && indices[i] < 0 {
+				indices[i] = position
+				matched++
+			}
+		}
+	}
+	return indices, matched
+}
+
+func (m *ColumnMapper) reorder(record *Record) *Record {
+	mapped := &Record{
+		Sheet:  record.Sheet,
+		Row:    record.Row,
+		Values: make([]string, len(uploadColumns)),
+	}
+	for i, position := range m.indices {
+		if position >= 0 && position < len(record.Values) {
+			mapped.Values[i] = record.Values[position]
+		} else if position < 0 && uploadColumns[i] == ColumnAvailable {
+			mapped.Values[i] = availableByDefault
+		}
+	}
+	return mapped
+}
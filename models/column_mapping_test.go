@@ -0,0 +1,128 @@
+package models_test
+
+import (
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestColumnMapper_Header(t *testing.T) {
+	mapper := models.NewColumnMapper(nil)
+
+	header := &models.Record{Sheet: "offers", Row: 1, Values: []string{"Цена", "Название", "ID товара", "Кол-во"}}
+	mapped, err := mapper.Map(header)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Message)
+	}
+	if mapped != nil {
+		t.Errorf("Header row must be skipped, got %+v", mapped)
+	}
+
+	mapped, err = mapper.Map(&models.Record{Sheet: "offers", Row: 2, Values: []string{"100", "Товар", "1", "2"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Message)
+	}
+	expected := &models.Record{Sheet: "offers", Row: 2, Values: []string{"1", "Товар", "100", "2", "true"}}
+	if !reflect.DeepEqual(mapped, expected) {
+		t.Errorf("Invalid mapped record.\nExpected %+v.\nGot %+v", expected, mapped)
+	}
+
+	// every sheet has its own header
+	mapped, err = mapper.Map(&models.Record{Sheet: "other", Row: 1, Values: []string{"1", "Товар", "100", "2", "нет"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Message)
+	}
+	expected = &models.Record{Sheet: "other", Row: 1, Values: []string{"1", "Товар", "100", "2", "нет"}}
+	if !reflect.DeepEqual(mapped, expected) {
+		t.Errorf("Invalid positional record.\nExpected %+v.\nGot %+v", expected, mapped)
+	}
+}
+
+func TestColumnMapper_MissingColumns(t *testing.T) {
+	mapper := models.NewColumnMapper(nil)
+
+	_, err := mapper.Map(&models.Record{Sheet: "offers", Row: 1, Values: []string{"offer_id", "name", "available"}})
+	if err == nil {
+		t.Fatalf("Expected error for header without price and quantity")
+	}
+	if err.Code != http.StatusBadRequest {
+		t.Errorf("Invalid error code, expected %d, got %d", http.StatusBadRequest, err.Code)
+	}
+}
+
+func TestColumnMapper_Custom(t *testing.T) {
+	mapper := models.NewColumnMapper(map[string]string{
+		models.ColumnPrice:   "Розничная цена",
+		models.ColumnOfferId: "SKU",
+	})
+
+	mapped, err := mapper.Map(&models.Record{Row: 1, Values: []string{"SKU", "name", "Розничная  цена", "quantity", "available"}})
+	if err != nil || mapped != nil {
+		t.Fatalf("Expected header row to be skipped, got %+v, %+v", mapped, err)
+	}
+
+	mapped, err = mapper.Map(&models.Record{Row: 2, Values: []string{"7", "offer", "150", "3", "1"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Message)
+	}
+	expected := []string{"7", "offer", "150", "3", "1"}
+	if !reflect.DeepEqual(mapped.Values, expected) {
+		t.Errorf("Invalid mapped values.\nExpected %v.\nGot %v", expected, mapped.Values)
+	}
+
+	// custom mapping requires header
+	mapper = models.NewColumnMapper(map[string]string{models.ColumnPrice: "Розничная цена"})
+	_, err = mapper.Map(&models.Record{Row: 1, Values: []string{"7", "offer", "150", "3", "1"}})
+	if err == nil {
+		t.Errorf("Expected error for file without header")
+	}
+}
+
+func TestColumnMapper_RecordHeader(t *testing.T) {
+	mapper := models.NewColumnMapper(nil)
+
+	record := &models.Record{
+		Row:    1,
+		Header: []string{"name", "offer_id", "price", "quantity"},
+		Values: []string{"first", "1", "100", "2"},
+	}
+	mapped, err := mapper.Map(record)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Message)
+	}
+	expected := []string{"1", "first", "100", "2", "true"}
+	if mapped == nil || !reflect.DeepEqual(mapped.Values, expected) {
+		t.Errorf("Invalid mapped record, expected values %v, got %+v", expected, mapped)
+	}
+}
+
+func TestColumnMapper_RecordHeaderMissingColumns(t *testing.T) {
+	mapper := models.NewColumnMapper(nil)
+
+	record := &models.Record{
+		Row:    2,
+		Header: []string{"offer_id", "name", "quantity"},
+		Values: []string{"1", "first", "2"},
+	}
+	mapped, err := mapper.Map(record)
+	if err == nil || err.Code != http.StatusBadRequest || !strings.Contains(err.Message, "has no required columns: price") {
+		t.Fatalf("Expected error about missing price column, got %+v", err)
+	}
+	if mapped != nil {
+		t.Errorf("Expected no record, got %+v", mapped)
+	}
+}
+
+func TestValidateColumnMapping(t *testing.T) {
+	if err := models.ValidateColumnMapping(map[string]string{models.ColumnName: "Товар"}); err != nil {
+		t.Errorf("Unexpected error: %s", err.Message)
+	}
+	if err := models.ValidateColumnMapping(map[string]string{"color": "Цвет"}); err == nil {
+		t.Errorf("Expected error for unknown column")
+	}
+	if err := models.ValidateColumnMapping(map[string]string{models.ColumnName: " "}); err == nil {
+		t.Errorf("Expected error for empty header")
+	}
+}
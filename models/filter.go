@@ -1,8 +1,191 @@
 package models
 
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const (
+	SortByOfferId   = "offer_id"
+	SortByName      = "name"
+	SortByPrice     = "price"
+	SortByQuantity  = "quantity"
+	SortByRelevance = "relevance"
+)
+
+const (
+	// SearchSubstring matches names containing query case insensitively
+	SearchSubstring = "substring"
+	// SearchFullText matches word forms of the query, falling back to trigram similarity
+	SearchFullText = "fulltext"
+	// SearchFuzzy matches names similar to the query by trigrams
+	SearchFuzzy = "fuzzy"
+)
+
+// sortColumns lists columns used for ordering by every sort field,
+// seller_id and offer_id are added so the order is unique and can be used for keyset pagination
+var sortColumns = map[string][]string{
+	SortByOfferId:  {"offer_id", "seller_id"},
+	SortByName:     {"name", "seller_id", "offer_id"},
+	SortByPrice:    {"price", "seller_id", "offer_id"},
+	SortByQuantity: {"quantity", "seller_id", "offer_id"},
+	// score is replaced with the relevance expression of the search mode
+	SortByRelevance: {"score", "seller_id", "offer_id"},
+}
+
 type Filter struct {
-	SellerId *int    `json:"seller_id"`
-	OfferId  *int    `json:"offer_id"`
-	Query    *string `json:"query"`
+	SellerIds   []int   `json:"seller_id"`
+	OfferIds    []int   `json:"offer_id"`
+	Query       *string `json:"query"`
+	SearchMode  string  `json:"search_mode"`
+	PriceMin    *int    `json:"price_min"`
+	PriceMax    *int    `json:"price_max"`
+	QuantityMin *int    `json:"quantity_min"`
+	QuantityMax *int    `json:"quantity_max"`
+	// IncludeUnavailable makes deleted offers to be returned too
+	IncludeUnavailable bool `json:"include_unavailable"`
+
+	// Sort is one of SortBy* constants, empty value means no ordering
+	Sort     string `json:"sort"`
+	SortDesc bool   `json:"sort_desc"`
+	// Limit of 0 means no limit
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+	Cursor *Cursor `json:"cursor"`
+}
+
+// Validate checks that range bounds are non-negative and min doesn't exceed max
+func (f *Filter) Validate() *Error {
+	switch f.SearchMode {
+	case "", SearchSubstring, SearchFullText, SearchFuzzy:
+	default:
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid value of search_mode, must be one of substring, fulltext, fuzzy",
+		}
+	}
+
+	if f.Sort == SortByRelevance && (f.Query == nil || f.SearchMode == "" || f.SearchMode == SearchSubstring) {
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Message: "Sorting by relevance requires query and fulltext or fuzzy search_mode",
+		}
+	}
+
+	ranges := []struct {
+		name     string
+		min, max *int
+	}{
+		{"price", f.PriceMin, f.PriceMax},
+		{"quantity", f.QuantityMin, f.QuantityMax},
+	}
+
+	for _, r := range ranges {
+		if r.min != nil && *r.min < 0 {
+			return &Error{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("Invalid value of %s_min, must be non-negative", r.name),
+			}
+		}
+		if r.max != nil && *r.max < 0 {
+			return &Error{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("Invalid value of %s_max, must be non-negative", r.name),
+			}
+		}
+		if r.min != nil && r.max != nil && *r.min > *r.max {
+			return &Error{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("Invalid range of %s, %s_min is greater than %s_max", r.name, r.name, r.name),
+			}
+		}
+	}
+	return nil
+}
+
+// Cursor points to the last sale of the previous page for keyset pagination
+type Cursor struct {
+	Sort     string      `json:"sort"`
+	SortDesc bool        `json:"desc"`
+	Value    interface{} `json:"value"`
+	SellerId int         `json:"seller_id"`
+	OfferId  int         `json:"offer_id"`
 }
 
+func IsValidSort(sort string) bool {
+	_, ok := sortColumns[sort]
+	return ok
+}
+
+func newCursor(sale Sale, sort string, sortDesc bool) *Cursor {
+	cursor := &Cursor{
+		Sort:     sort,
+		SortDesc: sortDesc,
+		SellerId: sale.SellerId,
+		OfferId:  sale.OfferId,
+	}
+	switch sort {
+	case SortByName:
+		cursor.Value = sale.Name
+	case SortByPrice:
+		cursor.Value = sale.Price
+	case SortByQuantity:
+		cursor.Value = sale.Quantity
+	case SortByRelevance:
+		if sale.Score != nil {
+			cursor.Value = *sale.Score
+		}
+	}
+	return cursor
+}
+
+// values returns cursor values in order of sortColumns of its sort field
+func (c *Cursor) values() []interface{} {
+	if c.Sort == SortByOfferId {
+		return []interface{}{c.OfferId, c.SellerId}
+	}
+	return []interface{}{c.Value, c.SellerId, c.OfferId}
+}
+
+func (c *Cursor) Encode() string {
+	cursorJson, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(cursorJson)
+}
+
+func DecodeCursor(encoded string) (*Cursor, error) {
+	cursorJson, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := new(Cursor)
+	err = json.Unmarshal(cursorJson, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if !IsValidSort(cursor.Sort) {
+		return nil, fmt.Errorf("invalid sort field %q in cursor", cursor.Sort)
+	}
+
+	switch cursor.Sort {
+	case SortByName:
+		if _, ok := cursor.Value.(string); !ok {
+			return nil, fmt.Errorf("invalid cursor value %v", cursor.Value)
+		}
+	case SortByPrice, SortByQuantity:
+		// numbers are decoded from json as float64
+		value, ok := cursor.Value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid cursor value %v", cursor.Value)
+		}
+		cursor.Value = int(value)
+	case SortByRelevance:
+		if _, ok := cursor.Value.(float64); !ok {
+			return nil, fmt.Errorf("invalid cursor value %v", cursor.Value)
+		}
+	}
+	return cursor, nil
+}
@@ -0,0 +1,47 @@
+package models_test
+
+import (
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"net/http"
+	"testing"
+)
+
+func intPtr(value int) *int {
+	return &value
+}
+
+func strPtr(value string) *string {
+	return &value
+}
+
+func TestFilter_Validate(t *testing.T) {
+	validFilters := []models.Filter{
+		{},
+		{PriceMin: intPtr(0), PriceMax: intPtr(100)},
+		{QuantityMin: intPtr(5), QuantityMax: intPtr(5)},
+		{Query: strPtr("test"), SearchMode: models.SearchFullText, Sort: models.SortByRelevance},
+	}
+	for _, filter := range validFilters {
+		if err := filter.Validate(); err != nil {
+			t.Errorf("Unexpected error %+v for filter %+v", err, filter)
+		}
+	}
+
+	invalidFilters := []models.Filter{
+		{PriceMin: intPtr(-1)},
+		{QuantityMax: intPtr(-10)},
+		{PriceMin: intPtr(200), PriceMax: intPtr(100)},
+		{QuantityMin: intPtr(2), QuantityMax: intPtr(1)},
+		{Query: strPtr("test"), SearchMode: "unknown"},
+		{Query: strPtr("test"), SearchMode: models.SearchSubstring, Sort: models.SortByRelevance},
+		{SearchMode: models.SearchFuzzy, Sort: models.SortByRelevance},
+	}
+	for _, filter := range invalidFilters {
+		err := filter.Validate()
+		if err == nil {
+			t.Errorf("Error expected for filter %+v", filter)
+		} else if err.Code != http.StatusBadRequest {
+			t.Errorf("Invalid error code, expected %d, got %d", http.StatusBadRequest, err.Code)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package models
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/tealeg/xlsx/v3"
+	"io"
+	"strconv"
+)
+
+// RowError describes why a row of uploaded file was rejected
+type RowError struct {
+	Sheet  string `json:"sheet"`
+	Row    int    `json:"row"`
+	Column string `json:"column"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("sheet %q, row %d, column %s: %s", e.Sheet, e.Row, e.Column, e.Reason)
+}
+
+type rowKey struct {
+	sheet string
+	row   int
+}
+
+func groupRowErrors(rowErrors []RowError) map[rowKey]string {
+	reasons := make(map[rowKey]string)
+	for _, rowError := range rowErrors {
+		key := rowKey{rowError.Sheet, rowError.Row}
+		if reason, ok := reasons[key]; ok {
+			reasons[key] = reason + "; " + rowError.Reason
+		} else {
+			reasons[key] = rowError.Reason
+		}
+	}
+	return reasons
+}
+
+// AnnotateExcel returns a copy of uploaded file values with rejection reasons added after the last column
+// of the rows which have errors
+func AnnotateExcel(source RowSource, rowErrors []RowError) (*xlsx.File, error) {
+	reasons := groupRowErrors(rowErrors)
+	annotated := xlsx.NewFile()
+
+	var annotatedSheet *xlsx.Sheet
+	for {
+		record, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		reason, hasReason := "", false
+		if rowError, ok := err.(*RowError); ok {
+			// row which source couldn't read is written with its raw value, like in WriteAnnotatedCSV
+			record = &Record{Sheet: rowError.Sheet, Row: rowError.Row, Values: []string{rowError.Value}}
+			reason, hasReason = rowError.Reason, true
+		} else if err != nil {
+			return nil, err
+		} else {
+			reason, hasReason = reasons[rowKey{record.Sheet, record.Row}]
+		}
+
+		sheetName := record.Sheet
+		if sheetName == "" {
+			sheetName = "Sheet1"
+		}
+		if annotatedSheet == nil || annotatedSheet.Name != sheetName {
+			annotatedSheet, err = annotated.AddSheet(sheetName)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// empty rows are skipped by sources, so they are added to keep row numbers the same
+		for annotatedSheet.MaxRow < record.Row-1 {
+			annotatedSheet.AddRow()
+		}
+
+		annotatedRow := annotatedSheet.AddRow()
+		for _, value := range record.Values {
+			annotatedRow.AddCell().SetString(value)
+		}
+		if hasReason {
+			annotatedRow.AddCell().SetString(reason)
+		}
+	}
+
+	if len(annotated.Sheets) == 0 {
+		_, err := annotated.AddSheet("Sheet1")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return annotated, nil
+}
+
+// WriteAnnotatedCSV writes all records of uploaded file as CSV with sheet name, row number
+// and rejection reason in the first columns
+func WriteAnnotatedCSV(out io.Writer, source RowSource, rowErrors []RowError) error {
+	reasons := groupRowErrors(rowErrors)
+	writer := csv.NewWriter(out)
+
+	err := writer.Write([]string{"sheet", "row", "error"})
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if rowError, ok := err.(*RowError); ok {
+			err = writer.Write([]string{rowError.Sheet, strconv.Itoa(rowError.Row), rowError.Reason, rowError.Value})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		csvRecord := []string{record.Sheet, strconv.Itoa(record.Row), reasons[rowKey{record.Sheet, record.Row}]}
+		err = writer.Write(append(csvRecord, record.Values...))
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func rowValues(row *xlsx.Row) []string {
+	var values []string
+	row.ForEachCell(func(c *xlsx.Cell) error {
+		values = append(values, c.Value)
+		return nil
+	})
+	return values
+}
@@ -0,0 +1,108 @@
+package models_test
+
+import (
+	"bytes"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"github.com/tealeg/xlsx/v3"
+	"testing"
+)
+
+func createFile(rowsVals [][]interface{}) *xlsx.File {
+	wb := xlsx.NewFile()
+	sheet, _ := wb.AddSheet("offers")
+	for _, rowVals := range rowsVals {
+		row := sheet.AddRow()
+		for _, cellVal := range rowVals {
+			row.AddCell().SetValue(cellVal)
+		}
+	}
+	return wb
+}
+
+func TestFromExcelRowError(t *testing.T) {
+	row := createRow([]interface{}{4, "offer_2", "bad price", 2, false})
+
+	_, err := models.FromExcelRow(row, 1)
+
+	rowError, ok := err.(*models.RowError)
+	if !ok {
+		t.Fatalf("Expected *RowError, got %v", err)
+	}
+
+	expected := models.RowError{Sheet: "test", Row: 1, Column: "price", Value: "bad price", Reason: "price is not an integer"}
+	if *rowError != expected {
+		t.Errorf("Invalid row error, expected %+v, got %+v", expected, *rowError)
+	}
+}
+
+func TestAnnotateExcel(t *testing.T) {
+	wb := createFile([][]interface{}{
+		{1, "offer_1", 100, 1, true},
+		{2, "offer_2", "bad price", 1, true},
+	})
+	rowErrors := []models.RowError{{Sheet: "offers", Row: 2, Column: "price", Value: "bad price", Reason: "price is not an integer"}}
+
+	annotated, err := models.AnnotateExcel(models.NewExcelSource(wb), rowErrors)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	sheet := annotated.Sheet["offers"]
+	annotation, _ := sheet.Cell(1, 5)
+	if annotation.Value != "price is not an integer" {
+		t.Errorf("Invalid annotation, expected %q, got %q", "price is not an integer", annotation.Value)
+	}
+	cleanRow, _ := sheet.Row(0)
+	cellsCount := 0
+	cleanRow.ForEachCell(func(c *xlsx.Cell) error {
+		cellsCount++
+		return nil
+	})
+	if cellsCount != 5 {
+		t.Errorf("Unexpected annotation of valid row, expected %d cells, got %d", 5, cellsCount)
+	}
+}
+
+func TestAnnotateExcel_UnreadableRows(t *testing.T) {
+	content := `{"offer_id": 1, "name": "first", "price": 100, "quantity": 2, "available": true}
+not json
+`
+	source, err := models.OpenRowSource(writeTempFile(t, "offers.jsonl", []byte(content)), models.SourceOptions{Format: models.FormatJsonl})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer source.Close()
+
+	annotated, err := models.AnnotateExcel(source, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	sheet := annotated.Sheet["Sheet1"]
+	value, _ := sheet.Cell(1, 0)
+	annotation, _ := sheet.Cell(1, 1)
+	if value.Value != "not json" || annotation.Value == "" {
+		t.Errorf("Unreadable row must be written with its reason, got %q %q", value.Value, annotation.Value)
+	}
+}
+
+func TestWriteAnnotatedCSV(t *testing.T) {
+	wb := createFile([][]interface{}{
+		{1, "offer_1", 100, 1, true},
+		{"bad", "offer_2", 100, 1, true},
+	})
+	rowErrors := []models.RowError{{Sheet: "offers", Row: 2, Column: "offer_id", Value: "bad", Reason: "offer_id is not an integer"}}
+
+	var out bytes.Buffer
+	err := models.WriteAnnotatedCSV(&out, models.NewExcelSource(wb), rowErrors)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := "sheet,row,error\n" +
+		"offers,1,,1,offer_1,100,1,true\n" +
+		"offers,2,offer_id is not an integer,bad,offer_2,100,1,true\n"
+	if out.String() != expected {
+		t.Errorf("Invalid csv.\nExpected %q.\nGot %q", expected, out.String())
+	}
+}
@@ -0,0 +1,416 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/tealeg/xlsx/v3"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	FormatXlsx  = "xlsx"
+	FormatCsv   = "csv"
+	FormatJsonl = "jsonl"
+)
+
+const (
+	EncodingUtf8        = "utf-8"
+	EncodingWindows1251 = "windows-1251"
+)
+
+// maxJsonlLineSize limits size of a single JSON Lines record
+const maxJsonlLineSize = 1024 * 1024
+
+// MaxInMemoryXlsxSize is the size of xlsx file above which its cells are kept on disk instead of memory
+const MaxInMemoryXlsxSize = 16 * 1024 * 1024
+
+// Record is a row of uploaded file represented as raw cell values
+type Record struct {
+	// Sheet is empty for formats without sheets
+	Sheet string
+	// Row is 1-based number of the row in the sheet or file
+	Row int
+	// Header is set for records which name their values themselves, like JSON Lines objects
+	Header []string
+	Values []string
+}
+
+// RowSource reads records of uploaded file one by one
+type RowSource interface {
+	// Next returns the next record or io.EOF when there are no records left.
+	// *RowError is returned for a record which can't be read, reading may continue after it.
+	Next() (*Record, error)
+	// TotalRows returns amount of rows in the file including empty ones, or 0 if it is unknown
+	TotalRows() int
+	Close() error
+}
+
+type SourceOptions struct {
+	// Format is one of Format* constants, empty value means it is detected from file
+	Format string `json:"format"`
+	// Delimiter separates values of CSV file, comma is used if it is empty
+	Delimiter string `json:"delimiter"`
+	// Encoding of CSV and JSON Lines files, one of Encoding* constants, UTF-8 is used if it is empty
+	Encoding string `json:"encoding"`
+	// ColumnMapping maps upload columns to header names used in the file, see ColumnMapper
+	ColumnMapping map[string]string `json:"column_mapping,omitempty"`
+}
+
+func (o *SourceOptions) Validate() *Error {
+	switch o.Format {
+	case "", FormatXlsx, FormatCsv, FormatJsonl:
+	default:
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid value of format, must be one of xlsx, csv, jsonl",
+		}
+	}
+
+	if o.Delimiter != "" && utf8.RuneCountInString(o.Delimiter) != 1 {
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid value of delimiter, must be a single character",
+		}
+	}
+
+	switch strings.ToLower(o.Encoding) {
+	case "", EncodingUtf8, EncodingWindows1251, "cp1251":
+	default:
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid value of encoding, must be utf-8 or windows-1251",
+		}
+	}
+	return ValidateColumnMapping(o.ColumnMapping)
+}
+
+// fileContentTypes maps content types of uploaded files to their formats,
+// format of application/octet-stream is detected by file name
+var fileContentTypes = map[string]string{
+	"text/csv":                 FormatCsv,
+	"application/csv":          FormatCsv,
+	"application/x-ndjson":     FormatJsonl,
+	"application/jsonl":        FormatJsonl,
+	"application/x-jsonlines":  FormatJsonl,
+	"application/jsonlines":    FormatJsonl,
+	"application/octet-stream": "",
+
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": FormatXlsx,
+}
+
+func normalizeContentType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+// IsFileContentType checks that content type is a type of uploaded file known by DetectFormat
+func IsFileContentType(contentType string) bool {
+	_, ok := fileContentTypes[normalizeContentType(contentType)]
+	return ok
+}
+
+// DetectFormat guesses format of uploaded file by its content type and name, xlsx is used when nothing matches
+func DetectFormat(contentType string, fileName string) string {
+	if format := fileContentTypes[normalizeContentType(contentType)]; format != "" {
+		return format
+	}
+
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".csv":
+		return FormatCsv
+	case ".jsonl", ".ndjson":
+		return FormatJsonl
+	}
+	return FormatXlsx
+}
+
+// OpenRowSource opens file of the given format, options.Format must be already set
+func OpenRowSource(filePath string, options SourceOptions) (RowSource, error) {
+	if options.Format == FormatXlsx {
+		var fileOptions []xlsx.FileOption
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if fileInfo.Size() > MaxInMemoryXlsxSize {
+			// rows are still parsed at once, but cells of huge sheets don't stay in memory
+			fileOptions = append(fileOptions, xlsx.UseDiskVCellStore)
+		}
+
+		wb, err := xlsx.OpenFile(filePath, fileOptions...)
+		if err != nil {
+			return nil, err
+		}
+		return NewExcelSource(wb), nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	totalRows, err := countLines(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var reader io.Reader = file
+	switch strings.ToLower(options.Encoding) {
+	case EncodingWindows1251, "cp1251":
+		reader = transform.NewReader(file, charmap.Windows1251.NewDecoder())
+	}
+
+	switch options.Format {
+	case FormatCsv:
+		delimiter := ','
+		if options.Delimiter != "" {
+			delimiter, _ = utf8.DecodeRuneInString(options.Delimiter)
+		}
+		source := newCsvSource(reader, file, delimiter)
+		// quoted values may span several lines, so it is only an estimate
+		source.totalRows = totalRows
+		return source, nil
+	case FormatJsonl:
+		source := newJsonlSource(reader, file)
+		source.totalRows = totalRows
+		return source, nil
+	}
+
+	file.Close()
+	return nil, fmt.Errorf("unknown format %q", options.Format)
+}
+
+// countLines counts lines of file and rewinds it to the beginning
+func countLines(file *os.File) (int, error) {
+	lines := 0
+	lastByte := byte('\n')
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			lines += bytes.Count(buf[:n], []byte{'\n'})
+			lastByte = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if lastByte != '\n' {
+		// the last line has no line break
+		lines++
+	}
+
+	_, err := file.Seek(0, io.SeekStart)
+	return lines, err
+}
+
+type excelSource struct {
+	file     *xlsx.File
+	sheetIdx int
+	rowIdx   int
+}
+
+// NewExcelSource reads records from all sheets of excelFile one after another
+func NewExcelSource(excelFile *xlsx.File) RowSource {
+	return &excelSource{file: excelFile}
+}
+
+func (s *excelSource) Next() (*Record, error) {
+	for s.sheetIdx < len(s.file.Sheets) {
+		sheet := s.file.Sheets[s.sheetIdx]
+		if s.rowIdx >= sheet.MaxRow {
+			s.sheetIdx++
+			s.rowIdx = 0
+			continue
+		}
+
+		row, err := sheet.Row(s.rowIdx)
+		s.rowIdx++
+		if err != nil {
+			return nil, err
+		}
+
+		record := excelRecord(row)
+		if isEmptyRecord(record) {
+			continue
+		}
+		return record, nil
+	}
+	return nil, io.EOF
+}
+
+func (s *excelSource) TotalRows() int {
+	totalRows := 0
+	for _, sheet := range s.file.Sheets {
+		totalRows += sheet.MaxRow
+	}
+	return totalRows
+}
+
+func (s *excelSource) Close() error {
+	for _, sheet := range s.file.Sheets {
+		sheet.Close()
+	}
+	return nil
+}
+
+func excelRecord(row *xlsx.Row) *Record {
+	record := &Record{
+		Row:    row.GetCoordinate() + 1,
+		Values: rowValues(row),
+	}
+	if row.Sheet != nil {
+		record.Sheet = row.Sheet.Name
+	}
+	return record
+}
+
+type csvSource struct {
+	reader    *csv.Reader
+	closer    io.Closer
+	row       int
+	totalRows int
+}
+
+func newCsvSource(reader io.Reader, closer io.Closer, delimiter rune) *csvSource {
+	csvReader := csv.NewReader(reader)
+	csvReader.Comma = delimiter
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+	csvReader.ReuseRecord = false
+
+	return &csvSource{
+		reader: csvReader,
+		closer: closer,
+	}
+}
+
+func (s *csvSource) Next() (*Record, error) {
+	for {
+		values, err := s.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		s.row++
+
+		if s.row == 1 && len(values) > 0 {
+			// byte order mark is left by some spreadsheet editors
+			values[0] = strings.TrimPrefix(values[0], "\uFEFF")
+		}
+
+		record := &Record{Row: s.row, Values: values}
+		if isEmptyRecord(record) {
+			continue
+		}
+		return record, nil
+	}
+}
+
+func (s *csvSource) TotalRows() int {
+	return s.totalRows
+}
+
+func (s *csvSource) Close() error {
+	return s.closer.Close()
+}
+
+type jsonlSource struct {
+	scanner   *bufio.Scanner
+	closer    io.Closer
+	row       int
+	totalRows int
+}
+
+func newJsonlSource(reader io.Reader, closer io.Closer) *jsonlSource {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxJsonlLineSize)
+
+	return &jsonlSource{
+		scanner: scanner,
+		closer:  closer,
+	}
+}
+
+func (s *jsonlSource) Next() (*Record, error) {
+	for s.scanner.Scan() {
+		s.row++
+		line := strings.TrimSpace(s.scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var object map[string]interface{}
+		err := json.Unmarshal([]byte(line), &object)
+		if err != nil {
+			return nil, &RowError{
+				Row:    s.row,
+				Value:  line,
+				Reason: "line is not a JSON object",
+			}
+		}
+
+		record := &Record{Row: s.row}
+		for key := range object {
+			record.Header = append(record.Header, key)
+		}
+		// keys are sorted so equal sets of keys give equal headers
+		sort.Strings(record.Header)
+		for _, key := range record.Header {
+			record.Values = append(record.Values, jsonValueString(object[key]))
+		}
+		return record, nil
+	}
+
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (s *jsonlSource) TotalRows() int {
+	return s.totalRows
+}
+
+func (s *jsonlSource) Close() error {
+	return s.closer.Close()
+}
+
+func jsonValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		valueJson, _ := json.Marshal(v)
+		return string(valueJson)
+	}
+}
+
+func isEmptyRecord(record *Record) bool {
+	for _, value := range record.Values {
+		if strings.TrimSpace(value) != "" {
+			return false
+		}
+	}
+	return true
+}
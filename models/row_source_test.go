@@ -0,0 +1,150 @@
+package models_test
+
+import (
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"golang.org/x/text/encoding/charmap"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readAll(t *testing.T, source models.RowSource) []models.Record {
+	var records []models.Record
+	for {
+		record, err := source.Next()
+		if err == io.EOF {
+			return records
+		}
+		if _, ok := err.(*models.RowError); ok {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		records = append(records, *record)
+	}
+}
+
+func writeTempFile(t *testing.T, name string, content []byte) string {
+	filePath := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatalf("Error writing temporary file: %s", err.Error())
+	}
+	return filePath
+}
+
+func TestCsvSource(t *testing.T) {
+	content, _ := charmap.Windows1251.NewEncoder().String("1;Товар;100;2;да\n\n2;\"Второй; товар\";200;0;нет\n")
+	filePath := writeTempFile(t, "offers.csv", []byte(content))
+
+	source, err := models.OpenRowSource(filePath, models.SourceOptions{
+		Format:    models.FormatCsv,
+		Delimiter: ";",
+		Encoding:  models.EncodingWindows1251,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer source.Close()
+
+	if source.TotalRows() != 3 {
+		t.Errorf("Invalid total rows, expected 3, got %d", source.TotalRows())
+	}
+
+	expected := []models.Record{
+		{Row: 1, Values: []string{"1", "Товар", "100", "2", "да"}},
+		{Row: 2, Values: []string{"2", "Второй; товар", "200", "0", "нет"}},
+	}
+	records := readAll(t, source)
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Invalid records.\nExpected %+v.\nGot %+v", expected, records)
+	}
+
+	query, err := models.FromRecord(&records[0], 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !query.Available || query.Sale.Name != "Товар" || query.Sale.Price != 100 {
+		t.Errorf("Invalid parsed row: %+v", query)
+	}
+}
+
+func TestJsonlSource(t *testing.T) {
+	content := `{"offer_id": 1, "name": "first", "price": 100, "quantity": 2, "available": true}
+
+{"name": "second", "offer_id": 2, "price": 200.0, "quantity": 0, "available": false}
+not json
+`
+	filePath := writeTempFile(t, "offers.jsonl", []byte(content))
+
+	source, err := models.OpenRowSource(filePath, models.SourceOptions{Format: models.FormatJsonl})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer source.Close()
+
+	if source.TotalRows() != 4 {
+		t.Errorf("Invalid total rows, expected 4, got %d", source.TotalRows())
+	}
+
+	header := []string{"available", "name", "offer_id", "price", "quantity"}
+	expected := []models.Record{
+		{Row: 1, Header: header, Values: []string{"true", "first", "1", "100", "2"}},
+		{Row: 3, Header: header, Values: []string{"false", "second", "2", "200", "0"}},
+	}
+	records := readAll(t, source)
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Invalid records.\nExpected %+v.\nGot %+v", expected, records)
+	}
+}
+
+func TestExcelSource(t *testing.T) {
+	wb := createFile([][]interface{}{
+		{1, "offer_1", 100, 1, true},
+		{},
+		{2, "offer_2", 200, 0, false},
+	})
+	filePath := filepath.Join(t.TempDir(), "offers.xlsx")
+	if err := wb.Save(filePath); err != nil {
+		t.Fatalf("Error saving file: %s", err.Error())
+	}
+
+	source, err := models.OpenRowSource(filePath, models.SourceOptions{Format: models.FormatXlsx})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer source.Close()
+
+	if source.TotalRows() != 3 {
+		t.Errorf("Invalid total rows, expected 3, got %d", source.TotalRows())
+	}
+
+	records := readAll(t, source)
+	if len(records) != 2 || records[1].Row != 3 || records[1].Values[1] != "offer_2" {
+		t.Errorf("Invalid records: %+v", records)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	cases := []struct {
+		contentType string
+		fileName    string
+		format      string
+	}{
+		{"text/csv; charset=utf-8", "/offers", models.FormatCsv},
+		{"application/x-ndjson", "/offers", models.FormatJsonl},
+		{"application/octet-stream", "/offers.CSV", models.FormatCsv},
+		{"", "/offers.ndjson", models.FormatJsonl},
+		{"application/octet-stream", "/offers.xlsx", models.FormatXlsx},
+		{"", "/offers", models.FormatXlsx},
+	}
+
+	for _, c := range cases {
+		format := models.DetectFormat(c.contentType, c.fileName)
+		if format != c.format {
+			t.Errorf("Invalid format for %q %q, expected %s, got %s", c.contentType, c.fileName, c.format, format)
+		}
+	}
+}
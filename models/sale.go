@@ -1,10 +1,12 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"strings"
+	"time"
 )
 
 type Sale struct {
@@ -13,15 +15,105 @@ type Sale struct {
 	Name     string `json:"name"`
 	Price    int    `json:"price"`
 	Quantity int    `json:"quantity"`
+	// Available is false for deleted offers, they are kept until purged, see PurgeDeletedBefore
+	Available bool       `json:"available"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// DeletedAt is when the offer became unavailable
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Score is relevance of the sale to the search query, it is set only for full-text and fuzzy search
+	Score *float64 `json:"score,omitempty"`
 }
 
+// saleColumns are selected in the order of fields returned by saleDest
+const saleColumns = `offer_id, seller_id, name, price, quantity, available, updated_at, deleted_at`
+
+// saleDest returns pointers to fields of sale for scanning saleColumns
+func saleDest(sale *Sale) []interface{} {
+	return []interface{}{&sale.OfferId, &sale.SellerId, &sale.Name, &sale.Price, &sale.Quantity, &sale.Available, &sale.UpdatedAt, &sale.DeletedAt}
+}
+
+// softDelete marks offers as unavailable, offers which are already unavailable aren't changed.
+// Its first parameter is id of the job making the change.
+const softDelete = `UPDATE sales SET available = false, deleted_at = now(), updated_at = now(), job_id = $1 WHERE available AND `
+
+// Sales changes offers and records every change into sales_audit, see FindHistory
 type Sales struct {
 	DB *sql.DB
+	tx *sql.Tx
+	// jobId is recorded as the origin of changes, see WithJob
+	jobId string
+}
+
+// executor is implemented by both *sql.DB and *sql.Tx
+type executor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (h *Sales) executor() executor {
+	if h.tx != nil {
+		return h.tx
+	}
+	return h.DB
+}
+
+// Begin starts a transaction and returns Sales which executes all queries inside of it
+func (h *Sales) Begin(ctx context.Context) (*Sales, error) {
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorln("Error starting transaction")
+
+		return nil, err
+	}
+	return &Sales{DB: h.DB, tx: tx, jobId: h.jobId}, nil
+}
+
+// WithJob returns Sales which records changes it makes as made by the job
+func (h *Sales) WithJob(jobId string) *Sales {
+	return &Sales{DB: h.DB, tx: h.tx, jobId: jobId}
+}
+
+// auditJobId is NULL for changes made without a job
+func (h *Sales) auditJobId() sql.NullString {
+	return sql.NullString{String: h.jobId, Valid: h.jobId != ""}
+}
+
+func (h *Sales) Commit() error {
+	if h.tx == nil {
+		return fmt.Errorf("no transaction to commit")
+	}
+	err := h.tx.Commit()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorln("Error committing transaction")
+	}
+	return err
 }
 
-func (h *Sales) AddSale(newSale Sale) (int64, error) {
-	query := `INSERT INTO sales (seller_id, offer_id, price, name, quantity) VALUES ($1, $2, $3, $4, $5);`
-	res, err := h.DB.Exec(query, newSale.SellerId, newSale.OfferId, newSale.Price, newSale.Name, newSale.Quantity)
+func (h *Sales) Rollback() error {
+	if h.tx == nil {
+		return fmt.Errorf("no transaction to rollback")
+	}
+	err := h.tx.Rollback()
+	if err == sql.ErrTxDone {
+		// transaction is rolled back automatically when its context is cancelled
+		return nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorln("Error rolling back transaction")
+	}
+	return err
+}
+
+func (h *Sales) AddSale(ctx context.Context, newSale Sale) (int64, error) {
+	query := `INSERT INTO sales (seller_id, offer_id, price, name, quantity, job_id) VALUES ($1, $2, $3, $4, $5, $6);`
+	res, err := h.executor().ExecContext(ctx, query, newSale.SellerId, newSale.OfferId, newSale.Price, newSale.Name, newSale.Quantity, h.auditJobId())
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -44,10 +136,10 @@ func (h *Sales) AddSale(newSale Sale) (int64, error) {
 	return rowsInserted, nil
 }
 
-func (h *Sales) FindByIdPair(sellerId int, offerId int) (*Sale, error) {
+func (h *Sales) FindByIdPair(ctx context.Context, sellerId int, offerId int) (*Sale, error) {
 	sale := new(Sale)
-	query := `SELECT offer_id, seller_id, name, price, quantity FROM sales WHERE seller_id = $1 AND offer_id = $2`
-	err := h.DB.QueryRow(query, sellerId, offerId).Scan(&sale.OfferId, &sale.SellerId, &sale.Name, &sale.Price, &sale.Quantity)
+	query := `SELECT ` + saleColumns + ` FROM sales WHERE seller_id = $1 AND offer_id = $2`
+	err := h.executor().QueryRowContext(ctx, query, sellerId, offerId).Scan(saleDest(sale)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.WithFields(log.Fields{
@@ -70,9 +162,9 @@ func (h *Sales) FindByIdPair(sellerId int, offerId int) (*Sale, error) {
 	return sale, nil
 }
 
-func (h *Sales) UpdateSale(sale Sale) (int64, error) {
-	query := `UPDATE sales SET price=$3, name=$4, quantity=$5 WHERE seller_id = $1 AND offer_id = $2;`
-	res, err := h.DB.Exec(query, sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity)
+func (h *Sales) UpdateSale(ctx context.Context, sale Sale) (int64, error) {
+	query := `UPDATE sales SET price=$3, name=$4, quantity=$5, updated_at=now(), job_id=$6 WHERE seller_id = $1 AND offer_id = $2;`
+	res, err := h.executor().ExecContext(ctx, query, sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity, h.auditJobId())
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -95,9 +187,10 @@ func (h *Sales) UpdateSale(sale Sale) (int64, error) {
 	return rowsUpdated, nil
 }
 
-func (h *Sales) DeleteByIdPair(sellerId int, offerId int) (int64, error) {
-	query := `DELETE FROM sales WHERE seller_id = $1 AND offer_id = $2;`
-	res, err := h.DB.Exec(query, sellerId, offerId)
+// DeleteByIdPair makes the offer unavailable, it is returned only with Filter.IncludeUnavailable afterwards
+func (h *Sales) DeleteByIdPair(ctx context.Context, sellerId int, offerId int) (int64, error) {
+	query := softDelete + `seller_id = $2 AND offer_id = $3;`
+	res, err := h.executor().ExecContext(ctx, query, h.auditJobId(), sellerId, offerId)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error":     err,
@@ -122,38 +215,391 @@ func (h *Sales) DeleteByIdPair(sellerId int, offerId int) (int64, error) {
 	return rowsDeleted, nil
 }
 
-func (h *Sales) FindByFilter(filter Filter) ([]Sale, error) {
-	var sales []Sale
+// UpsertBatchSize is the maximum amount of rows sent to the database in a single query
+const UpsertBatchSize = 500
+
+type salePair struct {
+	sellerId int
+	offerId  int
+}
+
+// UpsertBatch creates or updates available offers and makes unavailable ones deleted,
+// updating deleted offer makes it available again.
+// If several rows refer to the same offer, only the last one is applied.
+// Rows which weren't applied because of an error are counted in InternalErrors of the result.
+func (h *Sales) UpsertBatch(ctx context.Context, rows []UploadQueryRow) (UploadResult, error) {
+	var result UploadResult
+
+	upserts, deletes := splitRows(rows)
+	for start := 0; start < len(upserts); start += UpsertBatchSize {
+		end := start + UpsertBatchSize
+		if end > len(upserts) {
+			end = len(upserts)
+		}
+
+		created, updated, err := h.upsertChunk(ctx, upserts[start:end])
+		if err != nil {
+			result.InternalErrors += int64(len(upserts) - start + len(deletes))
+			return result, err
+		}
+		result.CreatedSales += created
+		result.UpdatedSales += updated
+	}
+
+	for start := 0; start < len(deletes); start += UpsertBatchSize {
+		end := start + UpsertBatchSize
+		if end > len(deletes) {
+			end = len(deletes)
+		}
+
+		deleted, err := h.deleteChunk(ctx, deletes[start:end])
+		if err != nil {
+			result.InternalErrors += int64(len(deletes) - start)
+			return result, err
+		}
+		result.DeletedSales += deleted
+	}
+
+	return result, nil
+}
+
+// splitRows returns sales to be created or updated and offers to be deleted, only the last row of every offer is taken
+func splitRows(rows []UploadQueryRow) ([]Sale, []salePair) {
+	lastRows := make(map[salePair]int)
+	for i, row := range rows {
+		lastRows[salePair{row.Sale.SellerId, row.Sale.OfferId}] = i
+	}
+
+	var upserts []Sale
+	var deletes []salePair
+	for i, row := range rows {
+		pair := salePair{row.Sale.SellerId, row.Sale.OfferId}
+		if lastRows[pair] != i {
+			continue
+		}
+		if row.Available {
+			sale := row.Sale
+			sale.Available = true
+			upserts = append(upserts, sale)
+		} else {
+			deletes = append(deletes, pair)
+		}
+	}
+	return upserts, deletes
+}
+
+func (h *Sales) upsertChunk(ctx context.Context, sales []Sale) (int64, int64, error) {
+	var values []string
+	valueArgs := []interface{}{h.auditJobId()}
+	for _, sale := range sales {
+		n := len(valueArgs)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $1)", n+1, n+2, n+3, n+4, n+5))
+		valueArgs = append(valueArgs, sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity)
+	}
+
+	// xmax of a freshly inserted row is 0, for a row updated on conflict it is id of the current transaction
+	query := `INSERT INTO sales (seller_id, offer_id, price, name, quantity, job_id) VALUES ` + strings.Join(values, ", ") +
+		` ON CONFLICT (seller_id, offer_id) DO UPDATE SET price = EXCLUDED.price, name = EXCLUDED.name, quantity = EXCLUDED.quantity,` +
+		` available = true, deleted_at = NULL, updated_at = now(), job_id = EXCLUDED.job_id` +
+		` RETURNING (xmax = 0) AS inserted;`
+
+	rows, err := h.executor().QueryContext(ctx, query, valueArgs...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"query":      query,
+			"rows_count": len(sales),
+		}).Errorln("Error upserting sales")
+
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	var created, updated int64
+	for rows.Next() {
+		var inserted bool
+		err := rows.Scan(&inserted)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"query": query,
+			}).Errorln("Error reading upsert result")
+
+			return 0, 0, err
+		}
+
+		if inserted {
+			created++
+		} else {
+			updated++
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"query": query,
+		}).Errorln("Error reading upsert result")
+
+		return 0, 0, err
+	}
+	return created, updated, nil
+}
+
+func (h *Sales) deleteChunk(ctx context.Context, pairs []salePair) (int64, error) {
+	var values []string
+	valueArgs := []interface{}{h.auditJobId()}
+	for _, pair := range pairs {
+		n := len(valueArgs)
+		values = append(values, fmt.Sprintf("($%d, $%d)", n+1, n+2))
+		valueArgs = append(valueArgs, pair.sellerId, pair.offerId)
+	}
+
+	query := softDelete + `(seller_id, offer_id) IN (` + strings.Join(values, ", ") + `);`
+	res, err := h.executor().ExecContext(ctx, query, valueArgs...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"query":      query,
+			"rows_count": len(pairs),
+		}).Errorln("Error deleting sales")
+
+		return 0, err
+	}
+
+	rowsDeleted, err := res.RowsAffected()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"query": query,
+		}).Errorln("Error getting amount of deleted rows")
+
+		return 0, err
+	}
+	return rowsDeleted, nil
+}
+
+// FindOfferIds returns ids of all available offers of the seller
+func (h *Sales) FindOfferIds(ctx context.Context, sellerId int) ([]int, error) {
+	query := `SELECT offer_id FROM sales WHERE seller_id = $1 AND available;`
+	rows, err := h.executor().QueryContext(ctx, query, sellerId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     query,
+			"seller_id": sellerId,
+		}).Errorln("Error selecting offer ids of seller")
 
+		return nil, err
+	}
+	defer rows.Close()
+
+	var offerIds []int
+	for rows.Next() {
+		var offerId int
+		err := rows.Scan(&offerId)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":     err,
+				"query":     query,
+				"seller_id": sellerId,
+			}).Errorln("Error selecting offer ids of seller")
+
+			return nil, err
+		}
+		offerIds = append(offerIds, offerId)
+	}
+	return offerIds, rows.Err()
+}
+
+// DeleteOffers makes the given offers of the seller unavailable and returns amount of deleted ones
+func (h *Sales) DeleteOffers(ctx context.Context, sellerId int, offerIds []int) (int64, error) {
+	var deleted int64
+	for start := 0; start < len(offerIds); start += UpsertBatchSize {
+		end := start + UpsertBatchSize
+		if end > len(offerIds) {
+			end = len(offerIds)
+		}
+
+		pairs := make([]salePair, 0, end-start)
+		for _, offerId := range offerIds[start:end] {
+			pairs = append(pairs, salePair{sellerId, offerId})
+		}
+		chunkDeleted, err := h.deleteChunk(ctx, pairs)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += chunkDeleted
+	}
+	return deleted, nil
+}
+
+// PurgeDeletedBefore removes offers which were deleted before cutoff from the database for good
+func (h *Sales) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	query := `DELETE FROM sales WHERE NOT available AND deleted_at < $1;`
+	res, err := h.executor().ExecContext(ctx, query, cutoff)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"cutoff": cutoff,
+		}).Errorln("Error purging deleted sales")
+
+		return 0, err
+	}
+
+	rowsDeleted, err := res.RowsAffected()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"query": query,
+		}).Errorln("Error getting amount of purged sales")
+
+		return 0, err
+	}
+	return rowsDeleted, nil
+}
+
+type SalesPage struct {
+	Items      []Sale `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Total      int    `json:"total"`
+}
+
+// filterConditions builds WHERE conditions of filter, placeholders are numbered starting after len(filterVals).
+// For full-text and fuzzy search it also returns expression of relevance score.
+func filterConditions(filter Filter, filterVals []interface{}) ([]string, []interface{}, string) {
 	var filters []string
-	var filterVals []interface{}
 
-	if filter.SellerId != nil {
-		newFilter := fmt.Sprintf("seller_id = $%d", len(filters)+1)
+	if len(filter.SellerIds) > 0 {
+		var newFilter string
+		newFilter, filterVals = inCondition("seller_id", filter.SellerIds, filterVals)
 		filters = append(filters, newFilter)
-		filterVals = append(filterVals, *filter.SellerId)
 	}
 
-	if filter.OfferId != nil {
-		newFilter := fmt.Sprintf("offer_id = $%d", len(filters)+1)
+	if len(filter.OfferIds) > 0 {
+		var newFilter string
+		newFilter, filterVals = inCondition("offer_id", filter.OfferIds, filterVals)
 		filters = append(filters, newFilter)
-		filterVals = append(filterVals, *filter.OfferId)
 	}
 
+	bounds := []struct {
+		condition string
+		value     *int
+	}{
+		{"price >= $%d", filter.PriceMin},
+		{"price <= $%d", filter.PriceMax},
+		{"quantity >= $%d", filter.QuantityMin},
+		{"quantity <= $%d", filter.QuantityMax},
+	}
+	for _, bound := range bounds {
+		if bound.value != nil {
+			newFilter := fmt.Sprintf(bound.condition, len(filterVals)+1)
+			filters = append(filters, newFilter)
+			filterVals = append(filterVals, *bound.value)
+		}
+	}
+
+	var scoreExpr string
 	if filter.Query != nil {
-		newFilter := fmt.Sprintf(`LOWER(name) LIKE '%%' || LOWER($%d) || '%%'`, len(filters)+1)
-		filters = append(filters, newFilter)
+		n := len(filterVals) + 1
 		filterVals = append(filterVals, *filter.Query)
+
+		switch filter.SearchMode {
+		case SearchFullText:
+			// names are mostly russian, so both configurations are used to match word forms,
+			// trigram similarity catches names with typos which have no lexemes in common with the query
+			tsQuery := fmt.Sprintf(`(plainto_tsquery('russian', $%d) || plainto_tsquery('english', $%d))`, n, n)
+			filters = append(filters, fmt.Sprintf(`(name_tsv @@ %s OR LOWER(name) %% LOWER($%d))`, tsQuery, n))
+			scoreExpr = fmt.Sprintf(`GREATEST(ts_rank(name_tsv, %s)::float8, similarity(LOWER(name), LOWER($%d))::float8)`, tsQuery, n)
+		case SearchFuzzy:
+			filters = append(filters, fmt.Sprintf(`LOWER(name) %% LOWER($%d)`, n))
+			scoreExpr = fmt.Sprintf(`similarity(LOWER(name), LOWER($%d))::float8`, n)
+		default:
+			filters = append(filters, fmt.Sprintf(`LOWER(name) LIKE '%%' || LOWER($%d) || '%%'`, n))
+		}
+	}
+
+	if !filter.IncludeUnavailable {
+		filters = append(filters, "available")
 	}
 
-	query := `SELECT offer_id, seller_id, name, price, quantity FROM sales`
+	return filters, filterVals, scoreExpr
+}
+
+// inCondition builds "column = $n" for a single value and "column IN ($n, ...)" for several ones
+func inCondition(column string, values []int, filterVals []interface{}) (string, []interface{}) {
+	if len(values) == 1 {
+		filterVals = append(filterVals, values[0])
+		return fmt.Sprintf("%s = $%d", column, len(filterVals)), filterVals
+	}
+
+	var placeholders []string
+	for _, value := range values {
+		filterVals = append(filterVals, value)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(filterVals)))
+	}
+	return fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")), filterVals
+}
+
+func (h *Sales) FindByFilter(ctx context.Context, filter Filter) ([]Sale, error) {
+	var sales []Sale
+
+	filters, filterVals, scoreExpr := filterConditions(filter, nil)
+
+	var columns []string
+	for _, column := range sortColumns[filter.Sort] {
+		if column == "score" {
+			// alias can't be used in WHERE, so the whole expression is compared
+			column = scoreExpr
+		}
+		columns = append(columns, column)
+	}
+	if filter.Cursor != nil && len(columns) > 0 {
+		// row comparison continues right after the cursor in the chosen order
+		var placeholders []string
+		for _, value := range filter.Cursor.values() {
+			filterVals = append(filterVals, value)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(filterVals)))
+		}
+
+		comparison := ">"
+		if filter.SortDesc {
+			comparison = "<"
+		}
+		filters = append(filters, fmt.Sprintf("(%s) %s (%s)",
+			strings.Join(columns, ", "), comparison, strings.Join(placeholders, ", ")))
+	}
+
+	query := `SELECT ` + saleColumns + ` FROM sales`
+	if scoreExpr != "" {
+		query = `SELECT ` + saleColumns + `, ` + scoreExpr + ` AS score FROM sales`
+	}
 	if len(filters) > 0 {
 		query += " WHERE "
 		query += strings.Join(filters, " AND ")
 	}
+
+	if len(columns) > 0 {
+		direction := " ASC"
+		if filter.SortDesc {
+			direction = " DESC"
+		}
+		query += " ORDER BY " + strings.Join(columns, direction+", ") + direction
+	}
+
+	if filter.Limit > 0 {
+		filterVals = append(filterVals, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(filterVals))
+	}
+
+	if filter.Offset > 0 {
+		filterVals = append(filterVals, filter.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(filterVals))
+	}
 	query += ";"
 
-	rows, err := h.DB.Query(query, filterVals...)
+	rows, err := h.executor().QueryContext(ctx, query, filterVals...)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error":  err,
@@ -168,7 +614,11 @@ func (h *Sales) FindByFilter(filter Filter) ([]Sale, error) {
 	for rows.Next() {
 		saleRow := Sale{}
 
-		err := rows.Scan(&saleRow.OfferId, &saleRow.SellerId, &saleRow.Name, &saleRow.Price, &saleRow.Quantity)
+		dest := saleDest(&saleRow)
+		if scoreExpr != "" {
+			dest = append(dest, &saleRow.Score)
+		}
+		err := rows.Scan(dest...)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -193,6 +643,63 @@ func (h *Sales) FindByFilter(filter Filter) ([]Sale, error) {
 	return sales, nil
 }
 
+// CountByFilter returns amount of sales matching filter, pagination fields of filter are ignored
+func (h *Sales) CountByFilter(ctx context.Context, filter Filter) (int, error) {
+	filters, filterVals, _ := filterConditions(filter, nil)
+
+	query := `SELECT COUNT(*) FROM sales`
+	if len(filters) > 0 {
+		query += " WHERE "
+		query += strings.Join(filters, " AND ")
+	}
+	query += ";"
+
+	var total int
+	err := h.executor().QueryRowContext(ctx, query, filterVals...).Scan(&total)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"filter": filter,
+		}).Errorln("Error counting with filter")
+
+		return 0, err
+	}
+	return total, nil
+}
+
+// FindPage returns a page of sales matching filter with a cursor to the next page, filter.Limit must be positive
+func (h *Sales) FindPage(ctx context.Context, filter Filter) (*SalesPage, error) {
+	if filter.Sort == "" {
+		filter.Sort = SortByOfferId
+	}
+
+	// one extra sale is selected to find out whether there is a next page
+	pageFilter := filter
+	pageFilter.Limit = filter.Limit + 1
+	sales, err := h.FindByFilter(ctx, pageFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := h.CountByFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &SalesPage{
+		Items: []Sale{},
+		Total: total,
+	}
+	if len(sales) > filter.Limit {
+		sales = sales[:filter.Limit]
+		page.NextCursor = newCursor(sales[len(sales)-1], filter.Sort, filter.SortDesc).Encode()
+	}
+	page.Items = append(page.Items, sales...)
+
+	return page, nil
+}
+
 func (h *Sales) Close() {
 	h.DB.Close()
 }
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// SaleAudit is a change of an offer recorded into sales_audit by trigger on sales table
+type SaleAudit struct {
+	AuditId int64        `json:"audit_id"`
+	Action  ChangeAction `json:"action"`
+	// JobId is unset for changes made without an upload job
+	JobId     *string   `json:"job_id,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+	Old       *Sale     `json:"old,omitempty"`
+	New       *Sale     `json:"new,omitempty"`
+}
+
+// FindHistory returns page of changes of the offer starting from the latest one and total amount of them
+func (h *Sales) FindHistory(ctx context.Context, sellerId int, offerId int, limit int, offset int) ([]SaleAudit, int, error) {
+	var total int
+	countQuery := `SELECT COUNT(*) FROM sales_audit WHERE seller_id = $1 AND offer_id = $2;`
+	err := h.executor().QueryRowContext(ctx, countQuery, sellerId, offerId).Scan(&total)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     countQuery,
+			"seller_id": sellerId,
+			"offer_id":  offerId,
+		}).Errorln("Error counting history of sale")
+
+		return nil, 0, err
+	}
+
+	query := `SELECT audit_id, action, job_id, changed_at, old_sale, new_sale FROM sales_audit ` +
+		`WHERE seller_id = $1 AND offer_id = $2 ORDER BY audit_id DESC LIMIT $3 OFFSET $4;`
+	rows, err := h.executor().QueryContext(ctx, query, sellerId, offerId, limit, offset)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     query,
+			"seller_id": sellerId,
+			"offer_id":  offerId,
+		}).Errorln("Error selecting history of sale")
+
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	history := []SaleAudit{}
+	for rows.Next() {
+		var audit SaleAudit
+		var jobId sql.NullString
+		var oldSale, newSale string
+		err := rows.Scan(&audit.AuditId, &audit.Action, &jobId, &audit.ChangedAt, &oldSale, &newSale)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":     err,
+				"query":     query,
+				"seller_id": sellerId,
+				"offer_id":  offerId,
+			}).Errorln("Error selecting history of sale")
+
+			return nil, 0, err
+		}
+		if jobId.Valid {
+			audit.JobId = &jobId.String
+		}
+		json.Unmarshal([]byte(oldSale), &audit.Old)
+		json.Unmarshal([]byte(newSale), &audit.New)
+		history = append(history, audit)
+	}
+	return history, total, rows.Err()
+}
@@ -0,0 +1,54 @@
+package models_test
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"reflect"
+	"testing"
+)
+
+func TestSales_FindHistory(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	countQuery := `SELECT COUNT\(\*\) FROM sales_audit WHERE seller_id \= \$1 AND offer_id \= \$2;`
+	mock.ExpectQuery(countQuery).WithArgs(10, 1).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	query := `SELECT audit_id, action, job_id, changed_at, old_sale, new_sale FROM sales_audit ` +
+		`WHERE seller_id \= \$1 AND offer_id \= \$2 ORDER BY audit_id DESC LIMIT \$3 OFFSET \$4;`
+	rows := sqlmock.NewRows([]string{"audit_id", "action", "job_id", "changed_at", "old_sale", "new_sale"}).
+		AddRow(3, "delete", nil, saleTime,
+			`{"offer_id": 1, "seller_id": 10, "name": "first", "price": 150, "quantity": 1, "available": true}`,
+			`{"offer_id": 1, "seller_id": 10, "name": "first", "price": 150, "quantity": 1, "available": false}`).
+		AddRow(2, "update", "job", saleTime,
+			`{"offer_id": 1, "seller_id": 10, "name": "first", "price": 100, "quantity": 1, "available": true}`,
+			`{"offer_id": 1, "seller_id": 10, "name": "first", "price": 150, "quantity": 1, "available": true}`)
+	mock.ExpectQuery(query).WithArgs(10, 1, 2, 0).WillReturnRows(rows)
+
+	history, total, err := sales.FindHistory(context.Background(), 10, 1, 2, 0)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if total != 3 || len(history) != 2 {
+		t.Fatalf("Invalid history, expected 2 of 3 changes, got %d of %d", len(history), total)
+	}
+	if history[0].Action != models.ChangeDelete || history[0].JobId != nil || history[0].New.Available {
+		t.Errorf("Invalid deletion: %+v", history[0])
+	}
+
+	jobId := "job"
+	expected := models.SaleAudit{
+		AuditId:   2,
+		Action:    models.ChangeUpdate,
+		JobId:     &jobId,
+		ChangedAt: saleTime,
+		Old:       &models.Sale{OfferId: 1, SellerId: 10, Name: "first", Price: 100, Quantity: 1, Available: true},
+		New:       &models.Sale{OfferId: 1, SellerId: 10, Name: "first", Price: 150, Quantity: 1, Available: true},
+	}
+	if !reflect.DeepEqual(history[1], expected) {
+		t.Errorf("Invalid update, expected %+v, got %+v", expected, history[1])
+	}
+}
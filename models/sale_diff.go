@@ -0,0 +1,219 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+type ChangeAction string
+
+const (
+	ChangeCreate ChangeAction = "create"
+	ChangeUpdate ChangeAction = "update"
+	ChangeDelete ChangeAction = "delete"
+	// ChangeRemove is deletion of offer missing from the file uploaded in replace mode
+	ChangeRemove ChangeAction = "remove"
+)
+
+func IsValidChangeAction(action ChangeAction) bool {
+	switch action {
+	case ChangeCreate, ChangeUpdate, ChangeDelete, ChangeRemove:
+		return true
+	}
+	return false
+}
+
+// SaleChange is a change which upload would make to an offer
+type SaleChange struct {
+	Action  ChangeAction `json:"action"`
+	OfferId int          `json:"offer_id"`
+	// Old is unset for created offers and New is unset for deleted ones
+	Old *Sale `json:"old,omitempty"`
+	New *Sale `json:"new,omitempty"`
+	// Fields are names of changed fields of updated offer
+	Fields []string `json:"fields,omitempty"`
+}
+
+// SaleDiff finds changes which UpsertBatch would make without applying them.
+// Offers changed by previous batches are remembered, so every batch sees changes of the previous ones.
+type SaleDiff struct {
+	sales *Sales
+	// changed keeps offers changed by previous batches, deleted offers are kept as nil
+	changed map[salePair]*Sale
+}
+
+func (h *Sales) NewDiff() *SaleDiff {
+	return &SaleDiff{
+		sales:   h,
+		changed: make(map[salePair]*Sale),
+	}
+}
+
+// Batch returns changes of the batch and counts them in result, unchanged offers aren't counted as updated.
+// Deleted offers which become available again are updated.
+func (d *SaleDiff) Batch(ctx context.Context, rows []UploadQueryRow) ([]SaleChange, UploadResult, error) {
+	var result UploadResult
+
+	upserts, deletes := splitRows(rows)
+
+	var unknown []salePair
+	for _, sale := range upserts {
+		pair := salePair{sale.SellerId, sale.OfferId}
+		if _, ok := d.changed[pair]; !ok {
+			unknown = append(unknown, pair)
+		}
+	}
+	for _, pair := range deletes {
+		if _, ok := d.changed[pair]; !ok {
+			unknown = append(unknown, pair)
+		}
+	}
+
+	current, err := d.sales.findByPairs(ctx, unknown)
+	if err != nil {
+		result.InternalErrors += int64(len(upserts) + len(deletes))
+		return nil, result, err
+	}
+	for pair, sale := range d.changed {
+		current[pair] = sale
+	}
+
+	var changes []SaleChange
+	for i := range upserts {
+		sale := &upserts[i]
+		pair := salePair{sale.SellerId, sale.OfferId}
+		old := current[pair]
+		d.changed[pair] = sale
+
+		if old == nil {
+			changes = append(changes, SaleChange{Action: ChangeCreate, OfferId: sale.OfferId, New: sale})
+			result.CreatedSales++
+			continue
+		}
+
+		fields := changedFields(old, sale)
+		if len(fields) == 0 {
+			continue
+		}
+		changes = append(changes, SaleChange{Action: ChangeUpdate, OfferId: sale.OfferId, Old: old, New: sale, Fields: fields})
+		result.UpdatedSales++
+	}
+
+	for _, pair := range deletes {
+		old := current[pair]
+		if old == nil || !old.Available {
+			d.changed[pair] = old
+			continue
+		}
+		d.changed[pair] = deletedSale(old)
+		changes = append(changes, SaleChange{Action: ChangeDelete, OfferId: pair.offerId, Old: old})
+		result.DeletedSales++
+	}
+
+	return changes, result, nil
+}
+
+// Remove returns changes removing the given offers of the seller, they are counted in result as removed
+func (d *SaleDiff) Remove(ctx context.Context, sellerId int, offerIds []int) ([]SaleChange, UploadResult, error) {
+	var result UploadResult
+
+	pairs := make([]salePair, 0, len(offerIds))
+	for _, offerId := range offerIds {
+		pairs = append(pairs, salePair{sellerId, offerId})
+	}
+	current, err := d.sales.findByPairs(ctx, pairs)
+	if err != nil {
+		return nil, result, err
+	}
+
+	var changes []SaleChange
+	for _, pair := range pairs {
+		old := current[pair]
+		if old == nil || !old.Available {
+			continue
+		}
+		d.changed[pair] = deletedSale(old)
+		changes = append(changes, SaleChange{Action: ChangeRemove, OfferId: pair.offerId, Old: old})
+		result.RemovedSales++
+	}
+	return changes, result, nil
+}
+
+// deletedSale returns unavailable copy of the sale
+func deletedSale(sale *Sale) *Sale {
+	deleted := *sale
+	deleted.Available = false
+	return &deleted
+}
+
+func changedFields(old *Sale, new *Sale) []string {
+	var fields []string
+	if old.Available != new.Available {
+		fields = append(fields, "available")
+	}
+	if old.Name != new.Name {
+		fields = append(fields, "name")
+	}
+	if old.Price != new.Price {
+		fields = append(fields, "price")
+	}
+	if old.Quantity != new.Quantity {
+		fields = append(fields, "quantity")
+	}
+	return fields
+}
+
+// findByPairs returns existing sales of the given offers including unavailable ones
+func (h *Sales) findByPairs(ctx context.Context, pairs []salePair) (map[salePair]*Sale, error) {
+	found := make(map[salePair]*Sale)
+
+	for start := 0; start < len(pairs); start += UpsertBatchSize {
+		end := start + UpsertBatchSize
+		if end > len(pairs) {
+			end = len(pairs)
+		}
+
+		var values []string
+		var valueArgs []interface{}
+		for _, pair := range pairs[start:end] {
+			n := len(valueArgs)
+			values = append(values, fmt.Sprintf("($%d, $%d)", n+1, n+2))
+			valueArgs = append(valueArgs, pair.sellerId, pair.offerId)
+		}
+
+		query := `SELECT ` + saleColumns + ` FROM sales WHERE (seller_id, offer_id) IN (` + strings.Join(values, ", ") + `);`
+		rows, err := h.executor().QueryContext(ctx, query, valueArgs...)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":      err,
+				"query":      query,
+				"rows_count": end - start,
+			}).Errorln("Error selecting sales")
+
+			return nil, err
+		}
+
+		for rows.Next() {
+			sale := new(Sale)
+			err := rows.Scan(saleDest(sale)...)
+			if err != nil {
+				rows.Close()
+				log.WithFields(log.Fields{
+					"error": err,
+					"query": query,
+				}).Errorln("Error selecting sales")
+
+				return nil, err
+			}
+			found[salePair{sale.SellerId, sale.OfferId}] = sale
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,83 @@
+package models_test
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"reflect"
+	"testing"
+)
+
+func availableSale(sale models.Sale) *models.Sale {
+	sale.Available = true
+	return &sale
+}
+
+func TestSaleDiff_Batch(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	rows := []models.UploadQueryRow{
+		{Sale: models.Sale{OfferId: 1, SellerId: 10, Name: "first", Price: 150, Quantity: 1}, Available: true},
+		{Sale: models.Sale{OfferId: 2, SellerId: 10, Name: "second", Price: 200, Quantity: 2}, Available: true},
+		{Sale: models.Sale{OfferId: 3, SellerId: 10, Name: "third", Price: 300, Quantity: 3}, Available: true},
+		{Sale: models.Sale{OfferId: 4, SellerId: 10}, Available: false},
+		// offer which is already deleted isn't deleted again
+		{Sale: models.Sale{OfferId: 5, SellerId: 10}, Available: false},
+		{Sale: models.Sale{OfferId: 6, SellerId: 10}, Available: false},
+	}
+
+	query := `SELECT (.+) FROM sales WHERE \(seller_id, offer_id\) IN \(\(\$1, \$2\), \(\$3, \$4\), \(\$5, \$6\), \(\$7, \$8\), \(\$9, \$10\), \(\$11, \$12\)\);`
+	mock.ExpectQuery(query).
+		WithArgs(10, 1, 10, 2, 10, 3, 10, 4, 10, 5, 10, 6).
+		WillReturnRows(sqlmock.NewRows(saleColumns).
+			AddRow(1, 10, "first", 100, 1, true, saleTime, nil).
+			AddRow(3, 10, "third", 300, 3, true, saleTime, nil).
+			AddRow(4, 10, "fourth", 400, 4, true, saleTime, nil).
+			AddRow(5, 10, "fifth", 500, 5, false, saleTime, saleTime))
+
+	diff := sales.NewDiff()
+	changes, result, err := diff.Batch(context.Background(), rows)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	expected := []models.SaleChange{
+		{
+			Action:  models.ChangeUpdate,
+			OfferId: 1,
+			Old:     &models.Sale{OfferId: 1, SellerId: 10, Name: "first", Price: 100, Quantity: 1, Available: true, UpdatedAt: &saleTime},
+			New:     availableSale(rows[0].Sale),
+			Fields:  []string{"price"},
+		},
+		{Action: models.ChangeCreate, OfferId: 2, New: availableSale(rows[1].Sale)},
+		{Action: models.ChangeDelete, OfferId: 4, Old: &models.Sale{OfferId: 4, SellerId: 10, Name: "fourth", Price: 400, Quantity: 4, Available: true, UpdatedAt: &saleTime}},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Invalid changes, expected %+v, got %+v", expected, changes)
+	}
+	expectedResult := models.UploadResult{CreatedSales: 1, UpdatedSales: 1, DeletedSales: 1}
+	if result != expectedResult {
+		t.Errorf("Invalid result, expected %+v, got %+v", expectedResult, result)
+	}
+
+	// the next batch sees offers changed by the previous one without querying them again,
+	// deleted offer becomes available again
+	nextRows := []models.UploadQueryRow{
+		{Sale: models.Sale{OfferId: 2, SellerId: 10, Name: "second", Price: 250, Quantity: 2}, Available: true},
+		{Sale: models.Sale{OfferId: 5, SellerId: 10, Name: "fifth", Price: 500, Quantity: 5}, Available: true},
+	}
+	changes, result, err = diff.Batch(context.Background(), nextRows)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if len(changes) != 2 || changes[0].Action != models.ChangeUpdate || changes[0].Old.Price != 200 ||
+		!reflect.DeepEqual(changes[1].Fields, []string{"available"}) || result.UpdatedSales != 2 {
+		t.Errorf("Invalid changes of the next batch: %+v", changes)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
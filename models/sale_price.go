@@ -0,0 +1,162 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// PricePoint is a price of an offer recorded into sale_prices by trigger on sales table
+type PricePoint struct {
+	// OldPrice is unset for the price offer was created with
+	OldPrice *int `json:"old_price,omitempty"`
+	Price    int  `json:"price"`
+	// JobId is unset for prices changed without an upload job
+	JobId     *string   `json:"job_id,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// PriceChange is a change of offer price made by an upload job
+type PriceChange struct {
+	OfferId       int     `json:"offer_id"`
+	OldPrice      int     `json:"old_price"`
+	Price         int     `json:"price"`
+	ChangePercent float64 `json:"change_percent"`
+}
+
+// PriceStats describes price changes made by an upload job, created offers aren't counted.
+// Offer changed several times by the job is counted once, from its price before the job to the last one.
+type PriceStats struct {
+	JobId         string  `json:"job_id"`
+	ChangedOffers int     `json:"changed_offers"`
+	AverageChange float64 `json:"average_change"`
+	// AverageChangePercent skips offers which were free before the change
+	AverageChangePercent float64 `json:"average_change_percent"`
+	// RisenOffers is the amount of offers whose price rose more than the requested percent,
+	// Risen is a page of them starting from the largest rise
+	RisenOffers int           `json:"risen_offers"`
+	Risen       []PriceChange `json:"risen"`
+}
+
+// FindPriceHistory returns page of prices of the offer starting from the earliest one and total amount of them
+func (h *Sales) FindPriceHistory(ctx context.Context, sellerId int, offerId int, limit int, offset int) ([]PricePoint, int, error) {
+	var total int
+	countQuery := `SELECT COUNT(*) FROM sale_prices WHERE seller_id = $1 AND offer_id = $2;`
+	err := h.executor().QueryRowContext(ctx, countQuery, sellerId, offerId).Scan(&total)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     countQuery,
+			"seller_id": sellerId,
+			"offer_id":  offerId,
+		}).Errorln("Error counting prices of sale")
+
+		return nil, 0, err
+	}
+
+	query := `SELECT old_price, price, job_id, changed_at FROM sale_prices ` +
+		`WHERE seller_id = $1 AND offer_id = $2 ORDER BY price_id LIMIT $3 OFFSET $4;`
+	rows, err := h.executor().QueryContext(ctx, query, sellerId, offerId, limit, offset)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     query,
+			"seller_id": sellerId,
+			"offer_id":  offerId,
+		}).Errorln("Error selecting prices of sale")
+
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	prices := []PricePoint{}
+	for rows.Next() {
+		var point PricePoint
+		var oldPrice sql.NullInt64
+		var jobId sql.NullString
+		err := rows.Scan(&oldPrice, &point.Price, &jobId, &point.ChangedAt)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":     err,
+				"query":     query,
+				"seller_id": sellerId,
+				"offer_id":  offerId,
+			}).Errorln("Error selecting prices of sale")
+
+			return nil, 0, err
+		}
+		if oldPrice.Valid {
+			price := int(oldPrice.Int64)
+			point.OldPrice = &price
+		}
+		if jobId.Valid {
+			point.JobId = &jobId.String
+		}
+		prices = append(prices, point)
+	}
+	return prices, total, rows.Err()
+}
+
+// jobPricesQuery selects the first old price and the last price of every offer changed by the job of the seller,
+// old price is NULL for offers created by the job
+const jobPricesQuery = `WITH job_prices AS (SELECT offer_id, (array_agg(old_price ORDER BY price_id))[1] AS old_price, ` +
+	`(array_agg(price ORDER BY price_id DESC))[1] AS price FROM sale_prices ` +
+	`WHERE seller_id = $1 AND job_id = $2 GROUP BY offer_id) `
+
+// FindPriceStats returns stats of price changes made by the job of the seller,
+// at most limit offers whose price rose more than risePercent are returned
+func (h *Sales) FindPriceStats(ctx context.Context, sellerId int, jobId string, risePercent float64, limit int) (PriceStats, error) {
+	stats := PriceStats{JobId: jobId, Risen: []PriceChange{}}
+
+	// offers whose price was changed back by the same job aren't changed
+	statsQuery := jobPricesQuery + `SELECT COUNT(*), COALESCE(AVG(price - old_price), 0)::float8, ` +
+		`COALESCE(AVG((price - old_price) * 100.0 / old_price) FILTER (WHERE old_price > 0), 0)::float8, ` +
+		`COUNT(*) FILTER (WHERE old_price > 0 AND (price - old_price) * 100.0 / old_price > $3) ` +
+		`FROM job_prices WHERE old_price IS NOT NULL AND old_price <> price;`
+	err := h.executor().QueryRowContext(ctx, statsQuery, sellerId, jobId, risePercent).
+		Scan(&stats.ChangedOffers, &stats.AverageChange, &stats.AverageChangePercent, &stats.RisenOffers)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     statsQuery,
+			"seller_id": sellerId,
+			"job_id":    jobId,
+		}).Errorln("Error counting price stats of job")
+
+		return stats, err
+	}
+
+	query := jobPricesQuery + `SELECT offer_id, old_price, price, ((price - old_price) * 100.0 / old_price)::float8 AS change_percent ` +
+		`FROM job_prices WHERE old_price > 0 AND (price - old_price) * 100.0 / old_price > $3 ` +
+		`ORDER BY change_percent DESC, offer_id LIMIT $4;`
+	rows, err := h.executor().QueryContext(ctx, query, sellerId, jobId, risePercent, limit)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     query,
+			"seller_id": sellerId,
+			"job_id":    jobId,
+		}).Errorln("Error selecting risen prices of job")
+
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var change PriceChange
+		err := rows.Scan(&change.OfferId, &change.OldPrice, &change.Price, &change.ChangePercent)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":     err,
+				"query":     query,
+				"seller_id": sellerId,
+				"job_id":    jobId,
+			}).Errorln("Error selecting risen prices of job")
+
+			return stats, err
+		}
+		stats.Risen = append(stats.Risen, change)
+	}
+	return stats, rows.Err()
+}
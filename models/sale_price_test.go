@@ -0,0 +1,78 @@
+package models_test
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"reflect"
+	"testing"
+)
+
+func TestSales_FindPriceHistory(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	countQuery := `SELECT COUNT\(\*\) FROM sale_prices WHERE seller_id \= \$1 AND offer_id \= \$2;`
+	mock.ExpectQuery(countQuery).WithArgs(10, 1).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	query := `SELECT old_price, price, job_id, changed_at FROM sale_prices ` +
+		`WHERE seller_id \= \$1 AND offer_id \= \$2 ORDER BY price_id LIMIT \$3 OFFSET \$4;`
+	rows := sqlmock.NewRows([]string{"old_price", "price", "job_id", "changed_at"}).
+		AddRow(nil, 100, nil, saleTime).
+		AddRow(100, 150, "job", saleTime)
+	mock.ExpectQuery(query).WithArgs(10, 1, 10, 0).WillReturnRows(rows)
+
+	prices, total, err := sales.FindPriceHistory(context.Background(), 10, 1, 10, 0)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	oldPrice, jobId := 100, "job"
+	expected := []models.PricePoint{
+		{Price: 100, ChangedAt: saleTime},
+		{OldPrice: &oldPrice, Price: 150, JobId: &jobId, ChangedAt: saleTime},
+	}
+	if total != 2 || !reflect.DeepEqual(prices, expected) {
+		t.Errorf("Invalid prices, expected %+v, got %+v of %d", expected, prices, total)
+	}
+}
+
+func TestSales_FindPriceStats(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	// every offer is aggregated once, from its first old price to its last price in the job
+	jobPricesQuery := `WITH job_prices AS \(SELECT offer_id, \(array_agg\(old_price ORDER BY price_id\)\)\[1\] AS old_price, ` +
+		`\(array_agg\(price ORDER BY price_id DESC\)\)\[1\] AS price FROM sale_prices ` +
+		`WHERE seller_id \= \$1 AND job_id \= \$2 GROUP BY offer_id\) `
+
+	statsQuery := jobPricesQuery + `SELECT COUNT\(\*\), (.+) FROM job_prices WHERE old_price IS NOT NULL AND old_price <> price;`
+	mock.ExpectQuery(statsQuery).WithArgs(10, "job", 20.0).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "avg", "avg_percent", "risen"}).AddRow(3, 12.5, 8.0, 1))
+
+	query := jobPricesQuery + `SELECT offer_id, old_price, price, (.+) AS change_percent ` +
+		`FROM job_prices WHERE old_price > 0 AND (.+) > \$3 ORDER BY change_percent DESC, offer_id LIMIT \$4;`
+	mock.ExpectQuery(query).WithArgs(10, "job", 20.0, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"offer_id", "old_price", "price", "change_percent"}).AddRow(2, 100, 150, 50.0))
+
+	stats, err := sales.FindPriceStats(context.Background(), 10, "job", 20, 100)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	expected := models.PriceStats{
+		JobId:                "job",
+		ChangedOffers:        3,
+		AverageChange:        12.5,
+		AverageChangePercent: 8,
+		RisenOffers:          1,
+		Risen:                []models.PriceChange{{OfferId: 2, OldPrice: 100, Price: 150, ChangePercent: 50}},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Invalid stats, expected %+v, got %+v", expected, stats)
+	}
+}
@@ -1,22 +1,30 @@
 package models_test
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/fertilewaif/avito-mx-backend-test/models"
 	"reflect"
 	"testing"
+	"time"
 )
 
+var saleTime = time.Date(2020, 12, 1, 10, 0, 0, 0, time.UTC)
+
 var sale = &models.Sale{
-	OfferId:  1,
-	SellerId: 10,
-	Name:     "Sales test",
-	Price:    300,
-	Quantity: 100500,
+	OfferId:   1,
+	SellerId:  10,
+	Name:      "Sales test",
+	Price:     300,
+	Quantity:  100500,
+	Available: true,
+	UpdatedAt: &saleTime,
 }
 
+var saleColumns = []string{"offer_id", "seller_id", "name", "price", "quantity", "available", "updated_at", "deleted_at"}
+
 func NewMock() (*sql.DB, sqlmock.Sqlmock) {
 	db, mock, _ := sqlmock.New()
 	return db, mock
@@ -27,10 +35,10 @@ func TestSales_AddSale(t *testing.T) {
 	sales := models.Sales{DB: db}
 	defer sales.Close()
 
-	query := `INSERT INTO sales \(seller_id, offer_id, price, name, quantity\) VALUES \(\$1, \$2, \$3, \$4, \$5\);`
-	mock.ExpectExec(query).WithArgs(sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity).WillReturnResult(sqlmock.NewResult(0, 1))
+	query := `INSERT INTO sales \(seller_id, offer_id, price, name, quantity, job_id\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\);`
+	mock.ExpectExec(query).WithArgs(sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity, nil).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	rowsInserted, err := sales.AddSale(*sale)
+	rowsInserted, err := sales.AddSale(context.Background(), *sale)
 
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
@@ -46,11 +54,11 @@ func TestSales_AddSaleError(t *testing.T) {
 	sales := models.Sales{DB: db}
 	defer sales.Close()
 
-	query := `INSERT INTO sales \(seller_id, offer_id, price, name, quantity\) VALUES \(\$1, \$2, \$3, \$4, \$5\);`
-	mock.ExpectExec(query).WithArgs(sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity).
+	query := `INSERT INTO sales \(seller_id, offer_id, price, name, quantity, job_id\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\);`
+	mock.ExpectExec(query).WithArgs(sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity, nil).
 		WillReturnError(fmt.Errorf("test error"))
 
-	_, err := sales.AddSale(*sale)
+	_, err := sales.AddSale(context.Background(), *sale)
 
 	if err == nil {
 		t.Errorf("Expected error, got nil")
@@ -62,10 +70,10 @@ func TestSales_DeleteByIdPair(t *testing.T) {
 	sales := models.Sales{DB: db}
 	defer sales.Close()
 
-	query := `DELETE FROM sales WHERE seller_id \= \$1 AND offer_id \= \$2;`
-	mock.ExpectExec(query).WithArgs(sale.SellerId, sale.OfferId).WillReturnResult(sqlmock.NewResult(0, 1))
+	query := `UPDATE sales SET available \= false, deleted_at \= now\(\), updated_at \= now\(\), job_id \= \$1 WHERE available AND seller_id \= \$2 AND offer_id \= \$3;`
+	mock.ExpectExec(query).WithArgs(nil, sale.SellerId, sale.OfferId).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	rowsDeleted, err := sales.DeleteByIdPair(sale.SellerId, sale.OfferId)
+	rowsDeleted, err := sales.DeleteByIdPair(context.Background(), sale.SellerId, sale.OfferId)
 
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
@@ -76,15 +84,33 @@ func TestSales_DeleteByIdPair(t *testing.T) {
 	}
 }
 
+func TestSales_PurgeDeletedBefore(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	query := `DELETE FROM sales WHERE NOT available AND deleted_at < \$1;`
+	mock.ExpectExec(query).WithArgs(saleTime).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	purged, err := sales.PurgeDeletedBefore(context.Background(), saleTime)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if purged != 3 {
+		t.Errorf("Invalid amount of purged rows, expected %d, got %d", 3, purged)
+	}
+}
+
 func TestSales_DeleteByIdPairError(t *testing.T) {
 	db, mock := NewMock()
 	sales := models.Sales{DB: db}
 	defer sales.Close()
 
-	query := `DELETE FROM sales WHERE seller_id \= \$1 AND offer_id \= \$2;`
-	mock.ExpectExec(query).WithArgs(sale.SellerId, sale.OfferId).WillReturnError(fmt.Errorf("test error"))
+	query := `UPDATE sales SET available \= false, deleted_at \= now\(\), updated_at \= now\(\), job_id \= \$1 WHERE available AND seller_id \= \$2 AND offer_id \= \$3;`
+	mock.ExpectExec(query).WithArgs(nil, sale.SellerId, sale.OfferId).WillReturnError(fmt.Errorf("test error"))
 
-	_, err := sales.DeleteByIdPair(sale.SellerId, sale.OfferId)
+	_, err := sales.DeleteByIdPair(context.Background(), sale.SellerId, sale.OfferId)
 
 	if err == nil {
 		t.Errorf("Expected error, got nil")
@@ -96,12 +122,12 @@ func TestSales_FindByIdPair(t *testing.T) {
 	sales := models.Sales{DB: db}
 	defer sales.Close()
 
-	query := `SELECT offer_id, seller_id, name, price, quantity FROM sales WHERE seller_id \= \$1 AND offer_id \= \$2`
-	rows := sqlmock.NewRows([]string{"offer_id", "seller_id", "name", "price", "quantity"}).
-		AddRow(sale.OfferId, sale.SellerId, sale.Name, sale.Price, sale.Quantity)
+	query := `SELECT offer_id, seller_id, name, price, quantity, available, updated_at, deleted_at FROM sales WHERE seller_id \= \$1 AND offer_id \= \$2`
+	rows := sqlmock.NewRows(saleColumns).
+		AddRow(sale.OfferId, sale.SellerId, sale.Name, sale.Price, sale.Quantity, true, saleTime, nil)
 	mock.ExpectQuery(query).WithArgs(sale.SellerId, sale.OfferId).WillReturnRows(rows)
 
-	resSale, err := sales.FindByIdPair(sale.SellerId, sale.OfferId)
+	resSale, err := sales.FindByIdPair(context.Background(), sale.SellerId, sale.OfferId)
 
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
@@ -120,17 +146,17 @@ func TestSales_FindByFilter(t *testing.T) {
 	offerId := 2
 	filterQuery := "test"
 	filter := models.Filter{
-		SellerId: nil,
-		OfferId:  &offerId,
-		Query:    &filterQuery,
+		SellerIds: nil,
+		OfferIds:  []int{offerId},
+		Query:     &filterQuery,
 	}
 
-	query := `SELECT offer_id, seller_id, name, price, quantity FROM sales WHERE offer_id \= \$1 AND LOWER\(name\) LIKE '%' \|\| LOWER\(\$2\) \|\| '%';`
-	rows := sqlmock.NewRows([]string{"offer_id", "seller_id", "name", "price", "quantity"}).
-		AddRow(sale.OfferId, sale.SellerId, sale.Name, sale.Price, sale.Quantity)
+	query := `SELECT (.+) FROM sales WHERE offer_id \= \$1 AND LOWER\(name\) LIKE '%' \|\| LOWER\(\$2\) \|\| '%' AND available;`
+	rows := sqlmock.NewRows(saleColumns).
+		AddRow(sale.OfferId, sale.SellerId, sale.Name, sale.Price, sale.Quantity, true, saleTime, nil)
 	mock.ExpectQuery(query).WillReturnRows(rows)
 
-	resSale, err := sales.FindByFilter(filter)
+	resSale, err := sales.FindByFilter(context.Background(), filter)
 
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
@@ -148,11 +174,11 @@ func TestSales_UpdateSale(t *testing.T) {
 	sales := models.Sales{DB: db}
 	defer sales.Close()
 
-	query := `UPDATE sales SET price\=\$3, name\=\$4, quantity\=\$5 WHERE seller_id \= \$1 AND offer_id \= \$2;`
-	mock.ExpectExec(query).WithArgs(sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity).
+	query := `UPDATE sales SET price\=\$3, name\=\$4, quantity\=\$5, updated_at\=now\(\), job_id\=\$6 WHERE seller_id \= \$1 AND offer_id \= \$2;`
+	mock.ExpectExec(query).WithArgs(sale.SellerId, sale.OfferId, sale.Price, sale.Name, sale.Quantity, nil).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
-	rowsUpdated, err := sales.UpdateSale(*sale)
+	rowsUpdated, err := sales.UpdateSale(context.Background(), *sale)
 
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
@@ -162,3 +188,215 @@ func TestSales_UpdateSale(t *testing.T) {
 		t.Errorf("Invalid rows updated, expected %d, got %d", 1, rowsUpdated)
 	}
 }
+
+func TestSales_Begin(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	query := `UPDATE sales SET available \= false, deleted_at \= now\(\), updated_at \= now\(\), job_id \= \$1 WHERE available AND seller_id \= \$2 AND offer_id \= \$3;`
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WithArgs("job", sale.SellerId, sale.OfferId).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	// transaction keeps the job changes are audited with
+	tx, err := sales.WithJob("job").Begin(context.Background())
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	_, err = tx.DeleteByIdPair(context.Background(), sale.SellerId, sale.OfferId)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
+
+func TestSales_UpsertBatch(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	rows := []models.UploadQueryRow{
+		{Sale: models.Sale{OfferId: 1, SellerId: 10, Name: "first", Price: 100, Quantity: 1}, Available: true},
+		{Sale: models.Sale{OfferId: 2, SellerId: 10, Name: "second", Price: 200, Quantity: 2}, Available: true},
+		{Sale: models.Sale{OfferId: 3, SellerId: 10, Name: "third", Price: 300, Quantity: 3}, Available: false},
+		// only the last row for the offer must be applied
+		{Sale: models.Sale{OfferId: 1, SellerId: 10, Name: "first", Price: 150, Quantity: 1}, Available: true},
+	}
+
+	upsertQuery := `INSERT INTO sales \(seller_id, offer_id, price, name, quantity, job_id\) VALUES \(\$2, \$3, \$4, \$5, \$6, \$1\), \(\$7, \$8, \$9, \$10, \$11, \$1\) ON CONFLICT \(seller_id, offer_id\) DO UPDATE SET (.+) RETURNING \(xmax \= 0\) AS inserted;`
+	mock.ExpectQuery(upsertQuery).
+		WithArgs("job", 10, 2, 200, "second", 2, 10, 1, 150, "first", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true).AddRow(false))
+
+	deleteQuery := `UPDATE sales SET (.+) WHERE available AND \(seller_id, offer_id\) IN \(\(\$2, \$3\)\);`
+	mock.ExpectExec(deleteQuery).WithArgs("job", 10, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	result, err := sales.WithJob("job").UpsertBatch(context.Background(), rows)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	expected := models.UploadResult{CreatedSales: 1, UpdatedSales: 1, DeletedSales: 1}
+	if result != expected {
+		t.Errorf("Invalid result, expected %+v, got %+v", expected, result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
+
+func TestSales_UpsertBatchError(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	rows := []models.UploadQueryRow{
+		{Sale: models.Sale{OfferId: 1, SellerId: 10, Name: "first", Price: 100, Quantity: 1}, Available: true},
+		{Sale: models.Sale{OfferId: 2, SellerId: 10, Name: "second", Price: 200, Quantity: 2}, Available: false},
+	}
+
+	mock.ExpectQuery(`INSERT INTO sales`).WillReturnError(fmt.Errorf("test error"))
+
+	result, err := sales.UpsertBatch(context.Background(), rows)
+
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+
+	if result.InternalErrors != 2 {
+		t.Errorf("Invalid amount of internal errors, expected %d, got %d", 2, result.InternalErrors)
+	}
+}
+
+func TestSales_FindPage(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	sellerId := 10
+	cursor := &models.Cursor{Sort: models.SortByPrice, SortDesc: true, Value: 500, SellerId: 10, OfferId: 7}
+	filter := models.Filter{
+		SellerIds: []int{sellerId},
+		Sort:      models.SortByPrice,
+		SortDesc:  true,
+		Limit:     1,
+		Cursor:    cursor,
+	}
+
+	query := `SELECT (.+) FROM sales WHERE seller_id \= \$1 AND available AND \(price, seller_id, offer_id\) < \(\$2, \$3, \$4\) ORDER BY price DESC, seller_id DESC, offer_id DESC LIMIT \$5;`
+	rows := sqlmock.NewRows(saleColumns).
+		AddRow(sale.OfferId, sale.SellerId, sale.Name, sale.Price, sale.Quantity, true, saleTime, nil).
+		AddRow(2, sale.SellerId, "next page", 200, 1, true, saleTime, nil)
+	mock.ExpectQuery(query).WithArgs(sellerId, 500, 10, 7, 2).WillReturnRows(rows)
+
+	countQuery := `SELECT COUNT\(\*\) FROM sales WHERE seller_id \= \$1 AND available;`
+	mock.ExpectQuery(countQuery).WithArgs(sellerId).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	page, err := sales.FindPage(context.Background(), filter)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if page.Total != 3 {
+		t.Errorf("Invalid total, expected %d, got %d", 3, page.Total)
+	}
+
+	saleSlice := []models.Sale{*sale}
+	if !reflect.DeepEqual(page.Items, saleSlice) {
+		t.Errorf("Invalid items, expected %+v, got %+v", saleSlice, page.Items)
+	}
+
+	nextCursor, err := models.DecodeCursor(page.NextCursor)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding cursor: %s", err.Error())
+	}
+	expectedCursor := &models.Cursor{Sort: models.SortByPrice, SortDesc: true, Value: sale.Price, SellerId: sale.SellerId, OfferId: sale.OfferId}
+	if !reflect.DeepEqual(nextCursor, expectedCursor) {
+		t.Errorf("Invalid next cursor, expected %+v, got %+v", expectedCursor, nextCursor)
+	}
+}
+
+func TestDecodeCursorError(t *testing.T) {
+	badCursors := []string{
+		"not base64!",
+		(&models.Cursor{Sort: "unknown"}).Encode(),
+		(&models.Cursor{Sort: models.SortByPrice, Value: "not a number"}).Encode(),
+	}
+
+	for _, badCursor := range badCursors {
+		_, err := models.DecodeCursor(badCursor)
+		if err == nil {
+			t.Errorf("Error expected. Input cursor: %s", badCursor)
+		}
+	}
+}
+
+func TestSales_FindByFilterRanges(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	priceMin, quantityMax := 100, 5
+	filter := models.Filter{
+		SellerIds:   []int{10, 11},
+		PriceMin:    &priceMin,
+		QuantityMax: &quantityMax,
+	}
+
+	query := `SELECT (.+) FROM sales WHERE seller_id IN \(\$1, \$2\) AND price >\= \$3 AND quantity <\= \$4 AND available;`
+	rows := sqlmock.NewRows(saleColumns)
+	mock.ExpectQuery(query).WithArgs(10, 11, priceMin, quantityMax).WillReturnRows(rows)
+
+	_, err := sales.FindByFilter(context.Background(), filter)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
+
+func TestSales_FindByFilterFuzzy(t *testing.T) {
+	db, mock := NewMock()
+	sales := models.Sales{DB: db}
+	defer sales.Close()
+
+	filterQuery := "tset"
+	filter := models.Filter{
+		Query:      &filterQuery,
+		SearchMode: models.SearchFuzzy,
+		Sort:       models.SortByRelevance,
+		SortDesc:   true,
+	}
+
+	query := `SELECT offer_id, seller_id, name, price, quantity, available, updated_at, deleted_at, similarity\(LOWER\(name\), LOWER\(\$1\)\)::float8 AS score FROM sales ` +
+		`WHERE LOWER\(name\) % LOWER\(\$1\) AND available ` +
+		`ORDER BY similarity\(LOWER\(name\), LOWER\(\$1\)\)::float8 DESC, seller_id DESC, offer_id DESC;`
+	rows := sqlmock.NewRows(append(saleColumns, "score")).
+		AddRow(sale.OfferId, sale.SellerId, sale.Name, sale.Price, sale.Quantity, true, saleTime, nil, 0.5)
+	mock.ExpectQuery(query).WithArgs(filterQuery).WillReturnRows(rows)
+
+	resSales, err := sales.FindByFilter(context.Background(), filter)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if len(resSales) != 1 || resSales[0].Score == nil || *resSales[0].Score != 0.5 {
+		t.Errorf("Invalid result, expected sale with score %f, got %+v", 0.5, resSales)
+	}
+}
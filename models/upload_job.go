@@ -0,0 +1,642 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrDuplicateIdempotencyKey is returned by AddJob when the seller already has a job with the same idempotency key
+var ErrDuplicateIdempotencyKey = errors.New("job with the same idempotency key already exists")
+
+// idempotencyIndex is the unique index of upload_jobs which keeps idempotency keys of every seller distinct
+const idempotencyIndex = "upload_jobs_idempotency_index"
+
+type JobState string
+
+const (
+	JobQueued  JobState = "queued"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	JobFailed  JobState = "failed"
+	// JobCancelled jobs keep changes applied before cancellation unless they are atomic
+	JobCancelled JobState = "cancelled"
+)
+
+const (
+	// ModeMerge changes only offers present in the file
+	ModeMerge = "merge"
+	// ModeReplace also removes offers of the seller missing from the file,
+	// the job fails if it would remove more than MaxRemovePercent of the catalogue
+	ModeReplace = "replace"
+)
+
+// UploadJob never shows CallbackUrl and IdempotencyKey in JSON, they are used only by the service
+type UploadJob struct {
+	JobId            string        `json:"job_id"`
+	SellerId         int           `json:"seller_id"`
+	Url              string        `json:"url"`
+	FilePath         string        `json:"-"`
+	Source           SourceOptions `json:"source"`
+	Atomic           bool          `json:"atomic"`
+	DryRun           bool          `json:"dry_run"`
+	Mode             string        `json:"mode"`
+	MaxRemovePercent int           `json:"max_remove_percent,omitempty"`
+	CallbackUrl      string        `json:"-"`
+	IdempotencyKey   string        `json:"-"`
+	State            JobState      `json:"state"`
+	CreatedAt        time.Time     `json:"created_at"`
+	StartedAt        *time.Time    `json:"started_at,omitempty"`
+	UpdatedAt        time.Time     `json:"updated_at"`
+	FinishedAt       *time.Time    `json:"finished_at,omitempty"`
+	UploadResult     UploadResult  `json:"upload_result"`
+	Error            *Error        `json:"error,omitempty"`
+}
+
+// ValidateMode checks upload mode and share of catalogue which it may remove, nil percent means the default one
+func ValidateMode(mode string, maxRemovePercent *int) *Error {
+	switch mode {
+	case "", ModeMerge, ModeReplace:
+	default:
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid value of mode, must be merge or replace",
+		}
+	}
+
+	if maxRemovePercent != nil && (*maxRemovePercent < 0 || *maxRemovePercent > 100) {
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid value of max_remove_percent, must be integer from 0 to 100",
+		}
+	}
+	return nil
+}
+
+func IsValidJobState(state JobState) bool {
+	switch state {
+	case JobQueued, JobRunning, JobDone, JobFailed, JobCancelled:
+		return true
+	}
+	return false
+}
+
+// Finished reports whether the job won't change its state anymore
+func (j *UploadJob) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// JobFilter restricts jobs returned by FindJobs, empty fields don't restrict anything
+type JobFilter struct {
+	SellerId *int
+	States   []JobState
+	// From and To bound creation time of jobs, To is exclusive
+	From *time.Time
+	To   *time.Time
+	// Limit is the maximum amount of returned jobs, non-positive limit means no limit
+	Limit  int
+	Offset int
+}
+
+// JobStore keeps upload jobs between status requests (and service restarts for persistent implementations)
+type JobStore interface {
+	// AddJob returns ErrDuplicateIdempotencyKey if the seller already has a job with the same idempotency key
+	AddJob(job UploadJob) error
+	UpdateJob(job UploadJob) error
+	FindById(jobId string) (*UploadJob, error)
+	FindJobs(filter JobFilter) ([]UploadJob, int, error)
+	// FindByIdempotencyKey returns the newest job of the seller with the key created not before since
+	FindByIdempotencyKey(sellerId int, key string, since time.Time) (*UploadJob, error)
+	// ReleaseIdempotencyKey clears the key of jobs of the seller created before cutoff, so it can be used again
+	ReleaseIdempotencyKey(sellerId int, key string, cutoff time.Time) error
+	DeleteById(jobId string) error
+	DeleteFinishedBefore(cutoff time.Time) ([]string, error)
+	AddRowErrors(jobId string, rowErrors []RowError) error
+	// FindRowErrors returns page of job row errors and total amount of them, non-positive limit means no limit
+	FindRowErrors(jobId string, limit int, offset int) ([]RowError, int, error)
+	AddDelivery(jobId string, delivery WebhookDelivery) error
+	// FindDeliveries returns webhook deliveries of the job in order of attempts
+	FindDeliveries(jobId string) ([]WebhookDelivery, error)
+	// AddChanges keeps changes found by dry run of the job
+	AddChanges(jobId string, changes []SaleChange) error
+	// FindChanges returns page of changes of dry run with the given action, or with any action if it is empty,
+	// and total amount of them, non-positive limit means no limit
+	FindChanges(jobId string, action ChangeAction, limit int, offset int) ([]SaleChange, int, error)
+}
+
+// UploadJobs is a JobStore backed by upload_jobs table
+type UploadJobs struct {
+	DB *sql.DB
+}
+
+func (h *UploadJobs) AddJob(job UploadJob) error {
+	query := `INSERT INTO upload_jobs (job_id, seller_id, url, file_path, format, delimiter, encoding, column_mapping, atomic, dry_run, mode, max_remove_percent, callback_url, idempotency_key, state, created_at, started_at, updated_at, finished_at, created_sales, updated_sales, deleted_sales, removed_sales, query_errors, internal_errors, rolled_back, error_code, error_message) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28);`
+	errCode, errMessage := splitError(job.Error)
+	columnMapping, _ := json.Marshal(job.Source.ColumnMapping)
+	_, err := h.DB.Exec(query, job.JobId, job.SellerId, job.Url, job.FilePath, job.Source.Format, job.Source.Delimiter, job.Source.Encoding, string(columnMapping), job.Atomic, job.DryRun, job.Mode, job.MaxRemovePercent, job.CallbackUrl, job.IdempotencyKey, job.State, job.CreatedAt, job.StartedAt, job.UpdatedAt, job.FinishedAt,
+		job.UploadResult.CreatedSales, job.UploadResult.UpdatedSales, job.UploadResult.DeletedSales, job.UploadResult.RemovedSales,
+		job.UploadResult.QueryErrors, job.UploadResult.InternalErrors, job.UploadResult.RolledBack, errCode, errMessage)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == idempotencyIndex {
+		return ErrDuplicateIdempotencyKey
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"job":   job,
+			"query": query,
+		}).Errorln("Error adding upload job")
+
+		return err
+	}
+	return nil
+}
+
+func (h *UploadJobs) UpdateJob(job UploadJob) error {
+	query := `UPDATE upload_jobs SET file_path=$2, format=$3, state=$4, started_at=$5, updated_at=$6, finished_at=$7, created_sales=$8, updated_sales=$9, deleted_sales=$10, removed_sales=$11, query_errors=$12, internal_errors=$13, rolled_back=$14, error_code=$15, error_message=$16 WHERE job_id = $1;`
+	errCode, errMessage := splitError(job.Error)
+	_, err := h.DB.Exec(query, job.JobId, job.FilePath, job.Source.Format, job.State, job.StartedAt, job.UpdatedAt, job.FinishedAt,
+		job.UploadResult.CreatedSales, job.UploadResult.UpdatedSales, job.UploadResult.DeletedSales, job.UploadResult.RemovedSales,
+		job.UploadResult.QueryErrors, job.UploadResult.InternalErrors, job.UploadResult.RolledBack, errCode, errMessage)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"job":   job,
+			"query": query,
+		}).Errorln("Error updating upload job")
+
+		return err
+	}
+	return nil
+}
+
+// jobColumns are selected in the order expected by scanJob
+const jobColumns = `job_id, seller_id, url, file_path, format, delimiter, encoding, column_mapping, atomic, dry_run, mode, max_remove_percent, callback_url, idempotency_key, state, created_at, started_at, updated_at, finished_at, created_sales, updated_sales, deleted_sales, removed_sales, query_errors, internal_errors, rolled_back, error_code, error_message`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (*UploadJob, error) {
+	job := new(UploadJob)
+	var startedAt, finishedAt sql.NullTime
+	var errCode sql.NullInt64
+	var errMessage sql.NullString
+
+	var columnMapping string
+
+	err := row.Scan(&job.JobId, &job.SellerId, &job.Url, &job.FilePath, &job.Source.Format, &job.Source.Delimiter, &job.Source.Encoding, &columnMapping, &job.Atomic, &job.DryRun, &job.Mode, &job.MaxRemovePercent, &job.CallbackUrl, &job.IdempotencyKey, &job.State, &job.CreatedAt, &startedAt, &job.UpdatedAt,
+		&finishedAt, &job.UploadResult.CreatedSales, &job.UploadResult.UpdatedSales, &job.UploadResult.DeletedSales, &job.UploadResult.RemovedSales,
+		&job.UploadResult.QueryErrors, &job.UploadResult.InternalErrors, &job.UploadResult.RolledBack, &errCode, &errMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	json.Unmarshal([]byte(columnMapping), &job.Source.ColumnMapping)
+	if errCode.Valid {
+		job.Error = &Error{
+			Code:    int(errCode.Int64),
+			Message: errMessage.String,
+		}
+	}
+	return job, nil
+}
+
+func (h *UploadJobs) FindById(jobId string) (*UploadJob, error) {
+	query := `SELECT ` + jobColumns + ` FROM upload_jobs WHERE job_id = $1`
+	job, err := scanJob(h.DB.QueryRow(query, jobId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.WithFields(log.Fields{
+				"query":  query,
+				"job_id": jobId,
+			}).Warningln("No jobs were selected")
+
+			return nil, nil
+		}
+
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"job_id": jobId,
+		}).Errorln("Error selecting upload job")
+		return nil, err
+	}
+	return job, nil
+}
+
+func (h *UploadJobs) FindByIdempotencyKey(sellerId int, key string, since time.Time) (*UploadJob, error) {
+	query := `SELECT ` + jobColumns + ` FROM upload_jobs WHERE seller_id = $1 AND idempotency_key = $2 AND created_at >= $3 ORDER BY created_at DESC LIMIT 1;`
+	job, err := scanJob(h.DB.QueryRow(query, sellerId, key, since))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     query,
+			"seller_id": sellerId,
+		}).Errorln("Error selecting upload job by idempotency key")
+		return nil, err
+	}
+	return job, nil
+}
+
+func (h *UploadJobs) ReleaseIdempotencyKey(sellerId int, key string, cutoff time.Time) error {
+	query := `UPDATE upload_jobs SET idempotency_key = '' WHERE seller_id = $1 AND idempotency_key = $2 AND created_at < $3;`
+	_, err := h.DB.Exec(query, sellerId, key, cutoff)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":     err,
+			"query":     query,
+			"seller_id": sellerId,
+		}).Errorln("Error releasing idempotency key")
+
+		return err
+	}
+	return nil
+}
+
+// FindJobs returns page of jobs matching filter, the newest go first, and total amount of matching jobs
+func (h *UploadJobs) FindJobs(filter JobFilter) ([]UploadJob, int, error) {
+	var conditions []string
+	var queryArgs []interface{}
+	if filter.SellerId != nil {
+		queryArgs = append(queryArgs, *filter.SellerId)
+		conditions = append(conditions, fmt.Sprintf("seller_id = $%d", len(queryArgs)))
+	}
+	if len(filter.States) > 0 {
+		var placeholders []string
+		for _, state := range filter.States {
+			queryArgs = append(queryArgs, state)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(queryArgs)))
+		}
+		conditions = append(conditions, "state IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if filter.From != nil {
+		queryArgs = append(queryArgs, *filter.From)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(queryArgs)))
+	}
+	if filter.To != nil {
+		queryArgs = append(queryArgs, *filter.To)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(queryArgs)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM upload_jobs` + where + `;`
+	err := h.DB.QueryRow(countQuery, queryArgs...).Scan(&total)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"query": countQuery,
+		}).Errorln("Error counting upload jobs")
+
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + jobColumns + ` FROM upload_jobs` + where + ` ORDER BY created_at DESC, job_id`
+	if filter.Limit > 0 {
+		queryArgs = append(queryArgs, filter.Limit, filter.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(queryArgs)-1, len(queryArgs))
+	}
+	query += ";"
+
+	rows, err := h.DB.Query(query, queryArgs...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"query": query,
+		}).Errorln("Error selecting upload jobs")
+
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	jobs := []UploadJob{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"query": query,
+			}).Errorln("Error selecting upload jobs")
+
+			return nil, 0, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, total, nil
+}
+
+// DeleteFinishedBefore deletes jobs finished before cutoff together with their row errors
+// and returns paths of their stored files
+func (h *UploadJobs) DeleteFinishedBefore(cutoff time.Time) ([]string, error) {
+	query := `DELETE FROM upload_jobs WHERE finished_at < $1 RETURNING file_path;`
+	rows, err := h.DB.Query(query, cutoff)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"cutoff": cutoff,
+		}).Errorln("Error deleting finished upload jobs")
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filePaths []string
+	for rows.Next() {
+		var filePath string
+		err := rows.Scan(&filePath)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"query": query,
+			}).Errorln("Error reading deleted upload jobs")
+
+			return nil, err
+		}
+		filePaths = append(filePaths, filePath)
+	}
+	return filePaths, nil
+}
+
+func (h *UploadJobs) DeleteById(jobId string) error {
+	query := `DELETE FROM upload_jobs WHERE job_id = $1;`
+	_, err := h.DB.Exec(query, jobId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"job_id": jobId,
+		}).Errorln("Error deleting upload job")
+
+		return err
+	}
+	return nil
+}
+
+func (h *UploadJobs) AddRowErrors(jobId string, rowErrors []RowError) error {
+	if len(rowErrors) == 0 {
+		return nil
+	}
+
+	var values []string
+	var valueArgs []interface{}
+	for _, rowError := range rowErrors {
+		n := len(valueArgs)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6))
+		valueArgs = append(valueArgs, jobId, rowError.Sheet, rowError.Row, rowError.Column, rowError.Value, rowError.Reason)
+	}
+
+	query := `INSERT INTO upload_job_errors (job_id, sheet, row_number, column_name, value, reason) VALUES ` + strings.Join(values, ", ") + `;`
+	_, err := h.DB.Exec(query, valueArgs...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":        err,
+			"query":        query,
+			"job_id":       jobId,
+			"errors_count": len(rowErrors),
+		}).Errorln("Error adding row errors of upload job")
+
+		return err
+	}
+	return nil
+}
+
+func (h *UploadJobs) FindRowErrors(jobId string, limit int, offset int) ([]RowError, int, error) {
+	var total int
+	countQuery := `SELECT COUNT(*) FROM upload_job_errors WHERE job_id = $1`
+	err := h.DB.QueryRow(countQuery, jobId).Scan(&total)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  countQuery,
+			"job_id": jobId,
+		}).Errorln("Error counting row errors of upload job")
+
+		return nil, 0, err
+	}
+
+	query := `SELECT sheet, row_number, column_name, value, reason FROM upload_job_errors WHERE job_id = $1 ORDER BY error_id`
+	queryArgs := []interface{}{jobId}
+	if limit > 0 {
+		query += ` LIMIT $2 OFFSET $3`
+		queryArgs = append(queryArgs, limit, offset)
+	}
+	query += ";"
+
+	rows, err := h.DB.Query(query, queryArgs...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"job_id": jobId,
+		}).Errorln("Error selecting row errors of upload job")
+
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	rowErrors := []RowError{}
+	for rows.Next() {
+		var rowError RowError
+		err := rows.Scan(&rowError.Sheet, &rowError.Row, &rowError.Column, &rowError.Value, &rowError.Reason)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"query":  query,
+				"job_id": jobId,
+			}).Errorln("Error selecting row errors of upload job")
+
+			return nil, 0, err
+		}
+		rowErrors = append(rowErrors, rowError)
+	}
+	return rowErrors, total, nil
+}
+
+func (h *UploadJobs) AddDelivery(jobId string, delivery WebhookDelivery) error {
+	query := `INSERT INTO upload_job_deliveries (job_id, attempt, sent_at, status_code, error) VALUES ($1, $2, $3, $4, $5);`
+	statusCode := sql.NullInt64{Int64: int64(delivery.StatusCode), Valid: delivery.StatusCode != 0}
+	deliveryError := sql.NullString{String: delivery.Error, Valid: delivery.Error != ""}
+	_, err := h.DB.Exec(query, jobId, delivery.Attempt, delivery.SentAt, statusCode, deliveryError)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"job_id": jobId,
+		}).Errorln("Error adding webhook delivery of upload job")
+
+		return err
+	}
+	return nil
+}
+
+func (h *UploadJobs) FindDeliveries(jobId string) ([]WebhookDelivery, error) {
+	query := `SELECT attempt, sent_at, status_code, error FROM upload_job_deliveries WHERE job_id = $1 ORDER BY delivery_id;`
+	rows, err := h.DB.Query(query, jobId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"job_id": jobId,
+		}).Errorln("Error selecting webhook deliveries of upload job")
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var statusCode sql.NullInt64
+		var deliveryError sql.NullString
+		err := rows.Scan(&delivery.Attempt, &delivery.SentAt, &statusCode, &deliveryError)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"query":  query,
+				"job_id": jobId,
+			}).Errorln("Error selecting webhook deliveries of upload job")
+
+			return nil, err
+		}
+		delivery.StatusCode = int(statusCode.Int64)
+		delivery.Error = deliveryError.String
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (h *UploadJobs) AddChanges(jobId string, changes []SaleChange) error {
+	// chunks keep amount of query parameters below the limit of PostgreSQL
+	for start := 0; start < len(changes); start += UpsertBatchSize {
+		end := start + UpsertBatchSize
+		if end > len(changes) {
+			end = len(changes)
+		}
+
+		err := h.addChangesChunk(jobId, changes[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *UploadJobs) addChangesChunk(jobId string, changes []SaleChange) error {
+	var values []string
+	var valueArgs []interface{}
+	for _, change := range changes {
+		n := len(valueArgs)
+		oldSale, _ := json.Marshal(change.Old)
+		newSale, _ := json.Marshal(change.New)
+		fields := strings.Join(change.Fields, ",")
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6))
+		valueArgs = append(valueArgs, jobId, change.Action, change.OfferId, string(oldSale), string(newSale), fields)
+	}
+
+	query := `INSERT INTO upload_job_changes (job_id, action, offer_id, old_sale, new_sale, fields) VALUES ` + strings.Join(values, ", ") + `;`
+	_, err := h.DB.Exec(query, valueArgs...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"query":         query,
+			"job_id":        jobId,
+			"changes_count": len(changes),
+		}).Errorln("Error adding changes of upload job")
+
+		return err
+	}
+	return nil
+}
+
+func (h *UploadJobs) FindChanges(jobId string, action ChangeAction, limit int, offset int) ([]SaleChange, int, error) {
+	where := ` WHERE job_id = $1`
+	queryArgs := []interface{}{jobId}
+	if action != "" {
+		where += ` AND action = $2`
+		queryArgs = append(queryArgs, action)
+	}
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM upload_job_changes` + where + `;`
+	err := h.DB.QueryRow(countQuery, queryArgs...).Scan(&total)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  countQuery,
+			"job_id": jobId,
+		}).Errorln("Error counting changes of upload job")
+
+		return nil, 0, err
+	}
+
+	query := `SELECT action, offer_id, old_sale, new_sale, fields FROM upload_job_changes` + where + ` ORDER BY change_id`
+	if limit > 0 {
+		queryArgs = append(queryArgs, limit, offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(queryArgs)-1, len(queryArgs))
+	}
+	query += ";"
+
+	rows, err := h.DB.Query(query, queryArgs...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"query":  query,
+			"job_id": jobId,
+		}).Errorln("Error selecting changes of upload job")
+
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	changes := []SaleChange{}
+	for rows.Next() {
+		var change SaleChange
+		var oldSale, newSale, fields string
+		err := rows.Scan(&change.Action, &change.OfferId, &oldSale, &newSale, &fields)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"query":  query,
+				"job_id": jobId,
+			}).Errorln("Error selecting changes of upload job")
+
+			return nil, 0, err
+		}
+		json.Unmarshal([]byte(oldSale), &change.Old)
+		json.Unmarshal([]byte(newSale), &change.New)
+		if fields != "" {
+			change.Fields = strings.Split(fields, ",")
+		}
+		changes = append(changes, change)
+	}
+	return changes, total, nil
+}
+
+func splitError(e *Error) (sql.NullInt64, sql.NullString) {
+	if e == nil {
+		return sql.NullInt64{}, sql.NullString{}
+	}
+	return sql.NullInt64{Int64: int64(e.Code), Valid: true}, sql.NullString{String: e.Message, Valid: true}
+}
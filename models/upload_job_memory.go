@@ -0,0 +1,271 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryJobStore is a JobStore which keeps jobs in process memory, mostly useful for tests
+type MemoryJobStore struct {
+	jobs       map[string]UploadJob
+	rowErrors  map[string][]RowError
+	deliveries map[string][]WebhookDelivery
+	changes    map[string][]SaleChange
+	mutex      sync.RWMutex
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{
+		jobs:       make(map[string]UploadJob),
+		rowErrors:  make(map[string][]RowError),
+		deliveries: make(map[string][]WebhookDelivery),
+		changes:    make(map[string][]SaleChange),
+	}
+}
+
+func (m *MemoryJobStore) AddJob(job UploadJob) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.jobs[job.JobId]; ok {
+		return fmt.Errorf("job %s already exists", job.JobId)
+	}
+	if job.IdempotencyKey != "" {
+		for _, other := range m.jobs {
+			if other.SellerId == job.SellerId && other.IdempotencyKey == job.IdempotencyKey {
+				return ErrDuplicateIdempotencyKey
+			}
+		}
+	}
+	m.jobs[job.JobId] = copyJob(job)
+	return nil
+}
+
+func (m *MemoryJobStore) UpdateJob(job UploadJob) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.jobs[job.JobId]; ok {
+		m.jobs[job.JobId] = copyJob(job)
+	}
+	return nil
+}
+
+func (m *MemoryJobStore) FindById(jobId string) (*UploadJob, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	job, ok := m.jobs[jobId]
+	if !ok {
+		return nil, nil
+	}
+	job = copyJob(job)
+	return &job, nil
+}
+
+func (m *MemoryJobStore) FindJobs(filter JobFilter) ([]UploadJob, int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	jobs := []UploadJob{}
+	for _, job := range m.jobs {
+		if filter.matches(job) {
+			jobs = append(jobs, copyJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+		}
+		return jobs[i].JobId < jobs[j].JobId
+	})
+
+	total := len(jobs)
+	offset := filter.Offset
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if filter.Limit > 0 && offset+filter.Limit < total {
+		end = offset + filter.Limit
+	}
+	return jobs[offset:end], total, nil
+}
+
+func (m *MemoryJobStore) FindByIdempotencyKey(sellerId int, key string, since time.Time) (*UploadJob, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var found *UploadJob
+	for _, job := range m.jobs {
+		if job.SellerId != sellerId || job.IdempotencyKey != key || job.CreatedAt.Before(since) {
+			continue
+		}
+		if found == nil || job.CreatedAt.After(found.CreatedAt) {
+			job = copyJob(job)
+			found = &job
+		}
+	}
+	return found, nil
+}
+
+func (m *MemoryJobStore) ReleaseIdempotencyKey(sellerId int, key string, cutoff time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for jobId, job := range m.jobs {
+		if job.SellerId == sellerId && job.IdempotencyKey == key && job.CreatedAt.Before(cutoff) {
+			job.IdempotencyKey = ""
+			m.jobs[jobId] = job
+		}
+	}
+	return nil
+}
+
+func (m *MemoryJobStore) DeleteFinishedBefore(cutoff time.Time) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var filePaths []string
+	for jobId, job := range m.jobs {
+		if job.FinishedAt == nil || !job.FinishedAt.Before(cutoff) {
+			continue
+		}
+		filePaths = append(filePaths, job.FilePath)
+		delete(m.jobs, jobId)
+		delete(m.rowErrors, jobId)
+		delete(m.deliveries, jobId)
+		delete(m.changes, jobId)
+	}
+	return filePaths, nil
+}
+
+func (m *MemoryJobStore) DeleteById(jobId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.jobs, jobId)
+	delete(m.rowErrors, jobId)
+	delete(m.deliveries, jobId)
+	delete(m.changes, jobId)
+	return nil
+}
+
+func (m *MemoryJobStore) AddRowErrors(jobId string, rowErrors []RowError) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.rowErrors[jobId] = append(m.rowErrors[jobId], rowErrors...)
+	return nil
+}
+
+func (m *MemoryJobStore) FindRowErrors(jobId string, limit int, offset int) ([]RowError, int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	rowErrors := m.rowErrors[jobId]
+	total := len(rowErrors)
+
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return append([]RowError{}, rowErrors[offset:end]...), total, nil
+}
+
+func (m *MemoryJobStore) AddDelivery(jobId string, delivery WebhookDelivery) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.deliveries[jobId] = append(m.deliveries[jobId], delivery)
+	return nil
+}
+
+func (m *MemoryJobStore) FindDeliveries(jobId string) ([]WebhookDelivery, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return append([]WebhookDelivery{}, m.deliveries[jobId]...), nil
+}
+
+func (m *MemoryJobStore) AddChanges(jobId string, changes []SaleChange) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.changes[jobId] = append(m.changes[jobId], changes...)
+	return nil
+}
+
+func (m *MemoryJobStore) FindChanges(jobId string, action ChangeAction, limit int, offset int) ([]SaleChange, int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	changes := []SaleChange{}
+	for _, change := range m.changes[jobId] {
+		if action == "" || change.Action == action {
+			changes = append(changes, change)
+		}
+	}
+	total := len(changes)
+
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return changes[offset:end], total, nil
+}
+
+// copyJob makes sure stored jobs don't share pointers with callers
+func copyJob(job UploadJob) UploadJob {
+	if job.StartedAt != nil {
+		startedAt := *job.StartedAt
+		job.StartedAt = &startedAt
+	}
+	if job.FinishedAt != nil {
+		finishedAt := *job.FinishedAt
+		job.FinishedAt = &finishedAt
+	}
+	if job.Error != nil {
+		jobError := *job.Error
+		job.Error = &jobError
+	}
+	if job.Source.ColumnMapping != nil {
+		columnMapping := make(map[string]string)
+		for column, header := range job.Source.ColumnMapping {
+			columnMapping[column] = header
+		}
+		job.Source.ColumnMapping = columnMapping
+	}
+	return job
+}
+
+// matches checks job against filter the same way as UploadJobs.FindJobs does
+func (f *JobFilter) matches(job UploadJob) bool {
+	if f.SellerId != nil && job.SellerId != *f.SellerId {
+		return false
+	}
+	if len(f.States) > 0 {
+		found := false
+		for _, state := range f.States {
+			found = found || job.State == state
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.From != nil && job.CreatedAt.Before(*f.From) {
+		return false
+	}
+	if f.To != nil && !job.CreatedAt.Before(*f.To) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,316 @@
+package models_test
+
+import (
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fertilewaif/avito-mx-backend-test/models"
+	"github.com/lib/pq"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var jobTime = time.Date(2020, 12, 1, 10, 0, 0, 0, time.UTC)
+
+var job = models.UploadJob{
+	JobId:    "test_job",
+	SellerId: 10,
+	Url:      "http://localhost/test.xlsx",
+	Source: models.SourceOptions{
+		Format:        "csv",
+		Delimiter:     ";",
+		Encoding:      "windows-1251",
+		ColumnMapping: map[string]string{"price": "Цена"},
+	},
+	Atomic:           true,
+	Mode:             models.ModeReplace,
+	MaxRemovePercent: 20,
+	CallbackUrl:      "http://localhost/callback",
+	IdempotencyKey:   "key-1",
+	State:            models.JobDone,
+	CreatedAt:        jobTime,
+	StartedAt:        &jobTime,
+	UpdatedAt:        jobTime,
+	UploadResult: models.UploadResult{
+		CreatedSales: 2,
+		UpdatedSales: 1,
+		QueryErrors:  3,
+	},
+	Error: &models.Error{
+		Code:    400,
+		Message: "test error",
+	},
+}
+
+func TestUploadJobs_AddJob(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	query := `INSERT INTO upload_jobs \(job_id, seller_id, url, file_path, format, delimiter, encoding, column_mapping, atomic, dry_run, mode, max_remove_percent, callback_url, idempotency_key, state, created_at, started_at, updated_at, finished_at, created_sales, updated_sales, deleted_sales, removed_sales, query_errors, internal_errors, rolled_back, error_code, error_message\)`
+	mock.ExpectExec(query).
+		WithArgs(job.JobId, job.SellerId, job.Url, "", "csv", ";", "windows-1251", `{"price":"Цена"}`, true, false, job.Mode, job.MaxRemovePercent, job.CallbackUrl, job.IdempotencyKey, job.State, job.CreatedAt, jobTime, job.UpdatedAt, nil, 2, 1, 0, 0, 3, 0, false, 400, "test error").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := jobs.AddJob(job)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
+
+func TestUploadJobs_AddJobDuplicateKey(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	mock.ExpectExec(`INSERT INTO upload_jobs`).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "upload_jobs_idempotency_index"})
+
+	err := jobs.AddJob(job)
+
+	if err != models.ErrDuplicateIdempotencyKey {
+		t.Errorf("Expected ErrDuplicateIdempotencyKey, got %v", err)
+	}
+}
+
+func TestUploadJobs_UpdateJobError(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	query := `UPDATE upload_jobs SET file_path\=\$2, format\=\$3, state\=\$4, started_at\=\$5`
+	mock.ExpectExec(query).WillReturnError(fmt.Errorf("test error"))
+
+	err := jobs.UpdateJob(job)
+
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+}
+
+func TestUploadJobs_FindById(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	query := `SELECT (.+) FROM upload_jobs WHERE job_id \= \$1`
+	rows := sqlmock.NewRows([]string{"job_id", "seller_id", "url", "file_path", "format", "delimiter", "encoding", "column_mapping", "atomic", "dry_run", "mode", "max_remove_percent", "callback_url", "idempotency_key", "state", "created_at", "started_at", "updated_at", "finished_at",
+		"created_sales", "updated_sales", "deleted_sales", "removed_sales", "query_errors", "internal_errors", "rolled_back", "error_code", "error_message"}).
+		AddRow(job.JobId, job.SellerId, job.Url, "", "csv", ";", "windows-1251", `{"price":"Цена"}`, true, false, job.Mode, job.MaxRemovePercent, job.CallbackUrl, job.IdempotencyKey, job.State, job.CreatedAt, jobTime, job.UpdatedAt, nil, 2, 1, 0, 0, 3, 0, false, 400, "test error")
+	mock.ExpectQuery(query).WithArgs(job.JobId).WillReturnRows(rows)
+
+	resJob, err := jobs.FindById(job.JobId)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(*resJob, job) {
+		t.Errorf("Invalid result, expected %+v, got %+v", job, *resJob)
+	}
+}
+
+func TestUploadJobs_FindByIdNoRows(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	query := `SELECT (.+) FROM upload_jobs WHERE job_id \= \$1`
+	rows := sqlmock.NewRows([]string{"job_id"})
+	mock.ExpectQuery(query).WithArgs("unknown").WillReturnRows(rows)
+
+	resJob, err := jobs.FindById("unknown")
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if resJob != nil {
+		t.Errorf("Expected nil, got %+v", resJob)
+	}
+}
+
+func TestMemoryJobStore(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+
+	if err := jobs.AddJob(job); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if err := jobs.AddJob(job); err == nil {
+		t.Errorf("Expected error on duplicate job, got nil")
+	}
+
+	resJob, _ := jobs.FindById(job.JobId)
+	if !reflect.DeepEqual(*resJob, job) {
+		t.Errorf("Invalid result, expected %+v, got %+v", job, *resJob)
+	}
+
+	// stored job mustn't be affected by changes of returned value
+	resJob.Error.Message = "changed"
+	resJob, _ = jobs.FindById(job.JobId)
+	if resJob.Error.Message != job.Error.Message {
+		t.Errorf("Stored job was changed through returned value")
+	}
+
+	jobs.DeleteById(job.JobId)
+	resJob, _ = jobs.FindById(job.JobId)
+	if resJob != nil {
+		t.Errorf("Expected nil after delete, got %+v", resJob)
+	}
+}
+
+func TestUploadJobs_FindDeliveries(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	query := `SELECT attempt, sent_at, status_code, error FROM upload_job_deliveries WHERE job_id \= \$1`
+	rows := sqlmock.NewRows([]string{"attempt", "sent_at", "status_code", "error"}).
+		AddRow(1, jobTime, nil, "connection refused").
+		AddRow(2, jobTime, 200, nil)
+	mock.ExpectQuery(query).WithArgs(job.JobId).WillReturnRows(rows)
+
+	deliveries, err := jobs.FindDeliveries(job.JobId)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	expected := []models.WebhookDelivery{
+		{Attempt: 1, SentAt: jobTime, Error: "connection refused"},
+		{Attempt: 2, SentAt: jobTime, StatusCode: 200},
+	}
+	if !reflect.DeepEqual(deliveries, expected) {
+		t.Errorf("Invalid result, expected %+v, got %+v", expected, deliveries)
+	}
+}
+
+func TestUploadJobs_FindJobs(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	sellerId := 10
+	filter := models.JobFilter{
+		SellerId: &sellerId,
+		States:   []models.JobState{models.JobDone, models.JobFailed},
+		From:     &jobTime,
+		Limit:    20,
+		Offset:   40,
+	}
+
+	countQuery := `SELECT COUNT\(\*\) FROM upload_jobs WHERE seller_id \= \$1 AND state IN \(\$2, \$3\) AND created_at \>\= \$4;`
+	mock.ExpectQuery(countQuery).WithArgs(sellerId, models.JobDone, models.JobFailed, jobTime).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(41))
+
+	query := `SELECT (.+) FROM upload_jobs WHERE seller_id \= \$1 AND state IN \(\$2, \$3\) AND created_at \>\= \$4 ORDER BY created_at DESC, job_id LIMIT \$5 OFFSET \$6;`
+	rows := sqlmock.NewRows([]string{"job_id", "seller_id", "url", "file_path", "format", "delimiter", "encoding", "column_mapping", "atomic", "dry_run", "mode", "max_remove_percent", "callback_url", "idempotency_key", "state", "created_at", "started_at", "updated_at", "finished_at",
+		"created_sales", "updated_sales", "deleted_sales", "removed_sales", "query_errors", "internal_errors", "rolled_back", "error_code", "error_message"}).
+		AddRow(job.JobId, job.SellerId, job.Url, "", "csv", ";", "windows-1251", `{"price":"Цена"}`, true, false, job.Mode, job.MaxRemovePercent, job.CallbackUrl, job.IdempotencyKey, job.State, job.CreatedAt, jobTime, job.UpdatedAt, nil, 2, 1, 0, 0, 3, 0, false, 400, "test error")
+	mock.ExpectQuery(query).WithArgs(sellerId, models.JobDone, models.JobFailed, jobTime, 20, 40).WillReturnRows(rows)
+
+	resJobs, total, err := jobs.FindJobs(filter)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if total != 41 || len(resJobs) != 1 || !reflect.DeepEqual(resJobs[0], job) {
+		t.Errorf("Invalid result, expected [%+v] of 41, got %+v of %d", job, resJobs, total)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
+
+func TestMemoryJobStore_FindJobs(t *testing.T) {
+	jobs := models.NewMemoryJobStore()
+
+	finishedAt := jobTime.Add(time.Hour)
+	for i, state := range []models.JobState{models.JobDone, models.JobRunning, models.JobDone} {
+		newJob := models.UploadJob{
+			JobId:     fmt.Sprintf("job_%d", i),
+			SellerId:  10 + i%2,
+			FilePath:  fmt.Sprintf("file_%d", i),
+			State:     state,
+			CreatedAt: jobTime.Add(time.Duration(i) * time.Minute),
+		}
+		if state == models.JobDone {
+			newJob.FinishedAt = &finishedAt
+		}
+		jobs.AddJob(newJob)
+	}
+
+	sellerId := 10
+	resJobs, total, _ := jobs.FindJobs(models.JobFilter{SellerId: &sellerId, States: []models.JobState{models.JobDone}, Limit: 1})
+	if total != 2 || len(resJobs) != 1 || resJobs[0].JobId != "job_2" {
+		t.Errorf("Invalid result, expected newest of 2 jobs, got %+v of %d", resJobs, total)
+	}
+
+	filePaths, _ := jobs.DeleteFinishedBefore(finishedAt.Add(time.Second))
+	if len(filePaths) != 2 {
+		t.Errorf("Expected files of 2 deleted jobs, got %v", filePaths)
+	}
+	_, total, _ = jobs.FindJobs(models.JobFilter{})
+	if total != 1 {
+		t.Errorf("Expected only unfinished job to be kept, got %d jobs", total)
+	}
+}
+
+func TestUploadJobs_AddChanges(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	changes := make([]models.SaleChange, models.UpsertBatchSize+1)
+	for i := range changes {
+		changes[i] = models.SaleChange{Action: models.ChangeRemove, OfferId: i}
+	}
+
+	// changes are inserted in chunks, so amount of query parameters stays within the limit
+	query := `INSERT INTO upload_job_changes \(job_id, action, offer_id, old_sale, new_sale, fields\) VALUES`
+	mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, models.UpsertBatchSize))
+	mock.ExpectExec(query+` \(\$1, \$2, \$3, \$4, \$5, \$6\);`).
+		WithArgs(job.JobId, models.ChangeRemove, models.UpsertBatchSize, "null", "null", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := jobs.AddChanges(job.JobId, changes); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %s", err.Error())
+	}
+}
+
+func TestUploadJobs_FindChanges(t *testing.T) {
+	db, mock := NewMock()
+	jobs := models.UploadJobs{DB: db}
+	defer db.Close()
+
+	countQuery := `SELECT COUNT\(\*\) FROM upload_job_changes WHERE job_id \= \$1 AND action \= \$2;`
+	mock.ExpectQuery(countQuery).WithArgs(job.JobId, models.ChangeUpdate).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	query := `SELECT action, offer_id, old_sale, new_sale, fields FROM upload_job_changes WHERE job_id \= \$1 AND action \= \$2 ORDER BY change_id LIMIT \$3 OFFSET \$4;`
+	rows := sqlmock.NewRows([]string{"action", "offer_id", "old_sale", "new_sale", "fields"}).
+		AddRow("update", 1, `{"offer_id":1,"seller_id":10,"name":"first","price":100,"quantity":1}`,
+			`{"offer_id":1,"seller_id":10,"name":"renamed","price":150,"quantity":1}`, "name,price")
+	mock.ExpectQuery(query).WithArgs(job.JobId, models.ChangeUpdate, 10, 0).WillReturnRows(rows)
+
+	changes, total, err := jobs.FindChanges(job.JobId, models.ChangeUpdate, 10, 0)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	expected := []models.SaleChange{{
+		Action:  models.ChangeUpdate,
+		OfferId: 1,
+		Old:     &models.Sale{OfferId: 1, SellerId: 10, Name: "first", Price: 100, Quantity: 1},
+		New:     &models.Sale{OfferId: 1, SellerId: 10, Name: "renamed", Price: 150, Quantity: 1},
+		Fields:  []string{"name", "price"},
+	}}
+	if total != 1 || !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Invalid result, expected %+v of 1, got %+v of %d", expected, changes, total)
+	}
+}
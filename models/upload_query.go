@@ -2,32 +2,61 @@ package models
 
 import (
 	"github.com/tealeg/xlsx/v3"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
+// MaxNameLength is the size of name column of sales, longer names would fail the whole batch of rows
+const MaxNameLength = 200
+
 type UploadQueryRow struct {
 	Sale      Sale
 	Available bool
 }
 
+// FromExcelRow parses row of uploaded xlsx file, returned error is always *RowError
 func FromExcelRow(row *xlsx.Row, sellerId int) (*UploadQueryRow, error) {
-	offerId, err := row.GetCell(0).Int()
+	return FromRecord(excelRecord(row), sellerId)
+}
+
+// FromRecord parses record of uploaded file with columns offer_id, name, price, quantity, available,
+// returned error is always *RowError
+func FromRecord(record *Record, sellerId int) (*UploadQueryRow, error) {
+	offerId, err := RecordOfferId(record)
 	if err != nil {
-		return nil, err
+		return nil, newRecordError(record, 0, "offer_id", "offer_id is not an integer")
+	}
+	if !isInt32(offerId) {
+		return nil, newRecordError(record, 0, "offer_id", "offer_id is out of range")
 	}
 
-	name := row.GetCell(1).String()
+	name := recordValue(record, 1)
+	if utf8.RuneCountInString(name) > MaxNameLength {
+		return nil, newRecordError(record, 1, "name", "name is longer than 200 characters")
+	}
 
-	price, err := row.GetCell(2).Int()
+	price, err := parseInt(recordValue(record, 2))
 	if err != nil {
-		return nil, err
+		return nil, newRecordError(record, 2, "price", "price is not an integer")
+	}
+	if !isInt32(price) {
+		return nil, newRecordError(record, 2, "price", "price is out of range")
 	}
 
-	quantity, err := row.GetCell(3).Int()
+	quantity, err := parseInt(recordValue(record, 3))
 	if err != nil {
-		return nil, err
+		return nil, newRecordError(record, 3, "quantity", "quantity is not an integer")
+	}
+	if !isInt32(quantity) {
+		return nil, newRecordError(record, 3, "quantity", "quantity is out of range")
 	}
 
-	available := row.GetCell(4).Bool()
+	available, err := parseBool(recordValue(record, 4))
+	if err != nil {
+		return nil, newRecordError(record, 4, "available", "available is not a boolean")
+	}
 
 	result := &UploadQueryRow{
 		Sale: Sale{
@@ -42,3 +71,55 @@ func FromExcelRow(row *xlsx.Row, sellerId int) (*UploadQueryRow, error) {
 
 	return result, nil
 }
+
+// RecordOfferId parses only offer_id of the record, it is known even if other values are invalid
+func RecordOfferId(record *Record) (int, error) {
+	return parseInt(recordValue(record, 0))
+}
+
+func recordValue(record *Record, colIdx int) string {
+	if colIdx >= len(record.Values) {
+		return ""
+	}
+	return record.Values[colIdx]
+}
+
+func newRecordError(record *Record, colIdx int, column string, reason string) *RowError {
+	return &RowError{
+		Sheet:  record.Sheet,
+		Row:    record.Row,
+		Column: column,
+		Value:  recordValue(record, colIdx),
+		Reason: reason,
+	}
+}
+
+// parseInt accepts integers written as floats too, since spreadsheets often store numbers this way
+func parseInt(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	intValue, err := strconv.Atoi(value)
+	if err == nil {
+		return intValue, nil
+	}
+
+	floatValue, floatErr := strconv.ParseFloat(value, 64)
+	if floatErr != nil || floatValue != math.Trunc(floatValue) {
+		return 0, err
+	}
+	return int(floatValue), nil
+}
+
+// isInt32 checks that value fits into int column of the database
+func isInt32(value int) bool {
+	return value >= math.MinInt32 && value <= math.MaxInt32
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "y", "+", "да":
+		return true, nil
+	case "", "0", "false", "no", "n", "-", "нет":
+		return false, nil
+	}
+	return false, strconv.ErrSyntax
+}
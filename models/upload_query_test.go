@@ -4,6 +4,7 @@ import (
 	"github.com/fertilewaif/avito-mx-backend-test/models"
 	"github.com/tealeg/xlsx/v3"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -57,6 +58,9 @@ func TestBadData(t *testing.T) {
 		{"bad offer_id", "offer_1", 300, 10, true},
 		{4, "offer_2", "bad price", 2, false},
 		{3, "offer_3", 10, "bad quantity", false},
+		{5, strings.Repeat("я", models.MaxNameLength+1), 10, 1, true},
+		{6, "offer_6", 1 << 31, 1, true},
+		{7, "offer_7", 10, -1<<31 - 1, true},
 	}
 
 	for _, rowVal := range rowsVals {
@@ -1,9 +1,23 @@
 package models
 
 type UploadResult struct {
-	CreatedSales   int64 `json:"created_sales"`
-	UpdatedSales   int64 `json:"updated_sales"`
-	DeletedSales   int64 `json:"deleted_sales"`
+	CreatedSales int64 `json:"created_sales"`
+	UpdatedSales int64 `json:"updated_sales"`
+	DeletedSales int64 `json:"deleted_sales"`
+	// RemovedSales are offers deleted by upload in replace mode because they were missing from the file
+	RemovedSales   int64 `json:"removed_sales"`
 	QueryErrors    int64 `json:"query_errors"`
 	InternalErrors int64 `json:"internal_errors"`
+	// RolledBack is set when atomic upload failed and none of its changes were applied
+	RolledBack bool `json:"rolled_back"`
+}
+
+// Add sums counters of other result into u
+func (u *UploadResult) Add(other UploadResult) {
+	u.CreatedSales += other.CreatedSales
+	u.UpdatedSales += other.UpdatedSales
+	u.DeletedSales += other.DeletedSales
+	u.RemovedSales += other.RemovedSales
+	u.QueryErrors += other.QueryErrors
+	u.InternalErrors += other.InternalErrors
 }
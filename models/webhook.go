@@ -0,0 +1,37 @@
+package models
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WebhookDelivery is a single attempt to send final status of a job to its callback url
+type WebhookDelivery struct {
+	Attempt int       `json:"attempt"`
+	SentAt  time.Time `json:"sent_at"`
+	// StatusCode is 0 when no response was received
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Succeeded reports whether callback accepted the status
+func (d *WebhookDelivery) Succeeded() bool {
+	return d.StatusCode >= 200 && d.StatusCode < 300
+}
+
+// ValidateCallbackUrl checks that callback url is an absolute http(s) url, empty url means no callback
+func ValidateCallbackUrl(callbackUrl string) *Error {
+	if callbackUrl == "" {
+		return nil
+	}
+
+	parsedUrl, err := url.Parse(callbackUrl)
+	if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") || parsedUrl.Host == "" {
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid value of callback_url, must be absolute http or https url",
+		}
+	}
+	return nil
+}
@@ -1,7 +1,12 @@
 package utils
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	mathrand "math/rand"
+	"os"
+	"strconv"
 )
 
 var (
@@ -11,7 +16,38 @@ var (
 func RandStringRunes(n int) string {
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+		b[i] = letterRunes[mathrand.Intn(len(letterRunes))]
 	}
 	return string(b)
-}
\ No newline at end of file
+}
+
+// NewUUID returns random UUID version 4, it is generated with crypto/rand so it can't be guessed
+func NewUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// GetEnvInt returns integer value of environment variable or defaultValue if it is unset or invalid
+func GetEnvInt(name string, defaultValue int) int {
+	strValue := os.Getenv(name)
+	if strValue == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(strValue)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name":  name,
+			"value": strValue,
+		}).Warningln("Invalid integer value of environment variable, using default")
+
+		return defaultValue
+	}
+	return value
+}